@@ -0,0 +1,195 @@
+package geerpc
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "strconv"
+    "sync"
+    "time"
+)
+
+/*
+认证在 Option 协商时完成: 客户端通过 Option.Credentials 生成认证信息，随 Option 一起发送，
+服务端的 Authenticator 校验后返回调用方的身份 (principal)，在服务方法和拦截器中通过 Principal(ctx) 获取。
+认证失败时服务端在 Option 的回复中携带错误信息并关闭连接，旧版本的客户端收不到回复，连接直接关闭。
+认证失败的错误码为 Unauthenticated，客户端不会重试，Authenticator 返回的普通 error 同样视为 Unauthenticated。
+*/
+
+
+// 客户端的认证信息
+type Credentials interface {
+    Auth() (map[string]string, error)
+}
+
+
+// 服务端的认证方式，ctx 中带有连接的 TLS 状态，返回调用方的身份
+type Authenticator interface {
+    Authenticate(ctx context.Context, auth map[string]string) (principal string, err error)
+}
+
+
+type AuthenticatorFunc func(ctx context.Context, auth map[string]string) (string, error)
+
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, auth map[string]string) (string, error) {
+    return f(ctx, auth)
+}
+
+
+var ErrUnauthenticated = NewError(Unauthenticated, "rpc server: unauthenticated")
+
+
+type principalKey struct{}
+
+
+// 返回连接认证后的调用方身份，没有认证时返回空字符串
+func Principal(ctx context.Context) string {
+    principal, _ := ctx.Value(principalKey{}).(string)
+    return principal
+}
+
+
+// 设置连接的认证方式，为 nil 时不认证，需要在开始服务前调用
+func (server *Server) SetAuthenticator(auth Authenticator) {
+    server.authenticator = auth
+}
+
+
+func (server *Server) authenticate(ctx context.Context, opt *Option) (context.Context, error) {
+    if server.authenticator == nil {
+        return ctx, nil
+    }
+    principal, err := server.authenticator.Authenticate(ctx, opt.Auth)
+    if err != nil {
+        if CodeOf(err) == Unknown {
+            err = NewError(Unauthenticated, err.Error())
+        }
+        return nil, err
+    }
+    return context.WithValue(ctx, principalKey{}, principal), nil
+}
+
+
+type tokenCredentials string
+
+
+// 静态 token
+func TokenCredentials(token string) Credentials {
+    return tokenCredentials(token)
+}
+
+
+func (t tokenCredentials) Auth() (map[string]string, error) {
+    return map[string]string{"token": string(t)}, nil
+}
+
+
+// 校验静态 token，tokens 为 token 到调用方身份的映射
+func TokenAuthenticator(tokens map[string]string) Authenticator {
+    return AuthenticatorFunc(func(ctx context.Context, auth map[string]string) (string, error) {
+        principal, ok := tokens[auth["token"]]
+        if !ok || auth["token"] == "" {
+            return "", ErrUnauthenticated
+        }
+        return principal, nil
+    })
+}
+
+
+type hmacCredentials struct {
+    id string
+    secret []byte
+}
+
+
+// 使用 id 对应的密钥对当前时间和随机的 nonce 签名，密钥本身不会被发送
+func HMACCredentials(id string, secret []byte) Credentials {
+    return &hmacCredentials{id: id, secret: secret}
+}
+
+
+func (c *hmacCredentials) Auth() (map[string]string, error) {
+    var nonce [16]byte
+    if _, err := rand.Read(nonce[:]); err != nil {
+        return nil, err
+    }
+    ts := strconv.FormatInt(time.Now().Unix(), 10)
+    n := hex.EncodeToString(nonce[:])
+    return map[string]string {
+        "id": c.id,
+        "ts": ts,
+        "nonce": n,
+        "sig": hmacSign(c.secret, c.id, ts, n),
+    }, nil
+}
+
+
+func hmacSign(secret []byte, id, ts, nonce string) string {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(id + ":" + ts + ":" + nonce))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+
+// 记录 maxSkew 内用过的 nonce，截获的认证信息不能被重放
+type nonceCache struct {
+    mtx sync.Mutex
+    seen map[string]time.Time   // id:nonce -> 过期时间
+    lastPrune time.Time
+}
+
+
+// nonce 第一次出现时记录并返回 true，签名过期后记录才会被清除
+func (c *nonceCache) add(key string, expire time.Time) bool {
+    c.mtx.Lock()
+    defer c.mtx.Unlock()
+
+    now := time.Now()
+    if now.Sub(c.lastPrune) > time.Minute {
+        for k, t := range c.seen {
+            if now.After(t) {
+                delete(c.seen, k)
+            }
+        }
+        c.lastPrune = now
+    }
+    if _, ok := c.seen[key]; ok {
+        return false
+    }
+    c.seen[key] = expire
+    return true
+}
+
+
+// 校验 HMAC 签名，secrets 为 id 到密钥的映射，签名时间和服务端时间相差超过 maxSkew 时拒绝，
+// maxSkew 内重复使用的 nonce 也会被拒绝，调用方身份为 id
+func HMACAuthenticator(secrets map[string][]byte, maxSkew time.Duration) Authenticator {
+    if maxSkew == 0 {
+        maxSkew = time.Minute * 5
+    }
+    nonces := &nonceCache{seen: make(map[string]time.Time)}
+    return AuthenticatorFunc(func(ctx context.Context, auth map[string]string) (string, error) {
+        secret, ok := secrets[auth["id"]]
+        if !ok {
+            return "", ErrUnauthenticated
+        }
+        ts, err := strconv.ParseInt(auth["ts"], 10, 64)
+        if err != nil {
+            return "", ErrUnauthenticated
+        }
+        if skew := time.Since(time.Unix(ts, 0)); skew > maxSkew || skew < -maxSkew {
+            return "", NewError(Unauthenticated, "rpc server: unauthenticated: signature expired")
+        }
+        if auth["nonce"] == "" || !hmac.Equal([]byte(auth["sig"]), []byte(hmacSign(secret, auth["id"], auth["ts"], auth["nonce"]))) {
+            return "", ErrUnauthenticated
+        }
+        // 签名时间在 [ts-maxSkew, ts+maxSkew] 内有效，记录保留到有效期结束
+        if !nonces.add(auth["id"] + ":" + auth["nonce"], time.Unix(ts, 0).Add(maxSkew)) {
+            return "", NewError(Unauthenticated, "rpc server: unauthenticated: replayed nonce")
+        }
+        return auth["id"], nil
+    })
+}
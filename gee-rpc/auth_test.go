@@ -0,0 +1,120 @@
+package geerpc
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "geerpc/codec"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+
+// 返回连接认证后的调用方身份
+func (foo Foo) Caller(ctx context.Context, args Args, reply *string) error {
+    *reply = Principal(ctx)
+    return nil
+}
+
+
+func TestAuthentication(test *testing.T) {
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    server.SetAuthenticator(TokenAuthenticator(map[string]string{"secret-token": "alice"}))
+    var seen string
+    server.Use(func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error {
+        seen = Principal(ctx)
+        return next(ctx, header, argv, replyv)
+    })
+    addr := serveTestServer(test, server)
+
+    client, err := Dial("tcp", addr, &Option{Credentials: TokenCredentials("secret-token")})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    var caller string
+    if err := client.Call(context.Background(), "Foo.Caller", &Args{}, &caller); err != nil || caller != "alice" || seen != "alice" {
+        test.Fatalf("expect alice, got %q and %q, error %v", caller, seen, err)
+    }
+
+    // 认证失败时客户端拿到服务端的错误
+    for _, opt := range []*Option{{Credentials: TokenCredentials("wrong")}, {}} {
+        _, err := Dial("tcp", addr, opt)
+        if !errors.Is(err, Unauthenticated) || !strings.Contains(err.Error(), "unauthenticated") || Retryable(err) {
+            test.Fatal("expect unauthenticated error, got", err)
+        }
+    }
+    if _, err := Dial("tcp", addr, &Option{CodecType: "application/unknown"}); err == nil {
+        test.Fatal("dial with unknown codec should fail")
+    }
+}
+
+
+// 旧版本的客户端发送 Option 后直接发送请求，不读取回复
+func TestBaselineClient(test *testing.T) {
+    addr := startTestServer(test)
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer conn.Close()
+    if err := json.NewEncoder(conn).Encode(map[string]interface{}{"MagicNumber": MagicNumber, "CodecType": codec.GobType}); err != nil {
+        test.Fatal("write option error:", err)
+    }
+
+    cc := codec.NewGobCodec(conn)
+    if err := cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2}); err != nil {
+        test.Fatal("write request error:", err)
+    }
+    var header codec.Header
+    var reply int
+    if err := cc.ReadHeader(&header); err != nil || header.Error != "" {
+        test.Fatalf("read header error: %v %q", err, header.Error)
+    }
+    if err := cc.ReadBody(&reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+}
+
+
+func TestHMACAuthentication(test *testing.T) {
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    server.SetAuthenticator(HMACAuthenticator(map[string][]byte{"svc-a": []byte("key-a")}, time.Minute))
+    addr := serveTestServer(test, server)
+
+    client, err := Dial("tcp", addr, &Option{Credentials: HMACCredentials("svc-a", []byte("key-a"))})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    var caller string
+    if err := client.Call(context.Background(), "Foo.Caller", &Args{}, &caller); err != nil || caller != "svc-a" {
+        test.Fatalf("expect svc-a, got %q, error %v", caller, err)
+    }
+
+    if _, err := Dial("tcp", addr, &Option{Credentials: HMACCredentials("svc-a", []byte("key-b"))}); err == nil {
+        test.Fatal("wrong secret should be rejected")
+    }
+    expired := map[string]string{"id": "svc-a", "ts": "1", "nonce": "n"}
+    expired["sig"] = hmacSign([]byte("key-a"), "svc-a", "1", "n")
+    if _, err := Dial("tcp", addr, &Option{Auth: expired}); err == nil || !strings.Contains(err.Error(), "expired") {
+        test.Fatal("expect expired signature error, got", err)
+    }
+
+    // 截获的认证信息在有效期内重放
+    auth, _ := HMACCredentials("svc-a", []byte("key-a")).Auth()
+    client, err = Dial("tcp", addr, &Option{Auth: auth})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    if _, err := Dial("tcp", addr, &Option{Auth: auth}); err == nil || !strings.Contains(err.Error(), "replayed") {
+        test.Fatal("expect replayed nonce error, got", err)
+    }
+}
@@ -1,7 +1,7 @@
 package geerpc
 
 import (
-    "encoding/json"
+    "crypto/tls"
     "errors"
     "fmt"
     "geerpc/codec"
@@ -24,6 +24,8 @@ type Call struct {
     Reply interface{}
     Error error
     Done chan *Call
+    deadline time.Time      // 来自 context 的截止时间，发送时换算为剩余的超时时间
+    metadata map[string]string
 }
 
 
@@ -40,8 +42,11 @@ type Client struct {
     mtx sync.Mutex
     seq uint64
     pending map[uint64]*Call
+    streams map[uint64]*Stream
     closing bool
     shutdown bool
+    interceptors []ClientInterceptor
+    info *ServerInfo        // 建立连接时服务端回复的信息
 }
 
 
@@ -70,6 +75,15 @@ func (client *Client) IsAvailable() bool {
 }
 
 
+// 正在等待响应的请求数，包括未结束的流，用于负载均衡
+func (client *Client) NumPending() int {
+    client.mtx.Lock()
+    defer client.mtx.Unlock()
+
+    return len(client.pending) + len(client.streams)
+}
+
+
 func (client *Client) registerCall(call *Call) (uint64, error) {
     client.mtx.Lock()
     defer client.mtx.Unlock()
@@ -107,6 +121,7 @@ func (client *Client) terminateCalls(err error) {
         call.Error = err
         call.done()
     }
+    client.terminateStreams(err)
 }
 
 
@@ -118,13 +133,18 @@ func (client *Client) receive() {
         if err != nil {
             break
         }
+        if cHeader.Stream {
+            err = client.receiveStream(&cHeader)
+            continue
+        }
 
         call := client.removeCall(cHeader.Seq)
         switch {
         case call == nil:
+            // 调用已被移除（如超时），body 直接丢弃，FrameCodec 可以不解码直接跳过
             err = client.cc.ReadBody(nil)
         case cHeader.Error != "":
-            call.Error = fmt.Errorf(cHeader.Error)
+            call.Error = headerError(&cHeader)
             err = client.cc.ReadBody(nil)
             call.done()
         default:
@@ -148,13 +168,22 @@ func NewClient(conn net.Conn, opt *Option) (*Client, error) {
         return nil, err
     }
 
-    if err := json.NewEncoder(conn).Encode(opt); err != nil {
+    info, err := handshake(conn, opt)
+    if err != nil {
         log.Println("rpc client: options error:", err)
         _ = conn.Close()
         return nil, err
     }
 
-    return newClientCodec(newCodecFunc(conn), opt), nil
+    var cc codec.Codec
+    if info.Compression != "" {
+        cc = codec.NewCompressCodec(conn, newCodecFunc, codec.GetCompressor(info.Compression), opt.CompressThreshold)
+    } else {
+        cc = newCodecFunc(conn)
+    }
+    client := newClientCodec(cc, opt)
+    client.info = info
+    return client, nil
 }
 
 
@@ -164,6 +193,8 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
         cc: cc,
         opt: opt,
         pending: make(map[uint64]*Call),
+        streams: make(map[uint64]*Stream),
+        info: &ServerInfo{},
     }
 
     go client.receive()
@@ -181,13 +212,18 @@ func parseOptions(opts ...*Option) (*Option, error) {
         return nil, errors.New("number of options is more than 1")
     }
 
-    opt := opts[0]
+    // 复制一份，同一个 Option 可以被并发建立的多个连接共用
+    opt := *opts[0]
     opt.MagicNumber = DefaultOption.MagicNumber
     if opt.CodecType == "" {
         opt.CodecType = DefaultOption.CodecType
     }
+    // 不等待回复时连接旧版本的服务端会一直阻塞到 ConnectTimeout
+    if opt.AckTimeout == 0 {
+        opt.AckTimeout = DefaultOption.AckTimeout
+    }
 
-    return opt, nil
+    return &opt, nil
 }
 
 
@@ -212,7 +248,12 @@ func dialTimeout(newCliFun newClientFunc, network, address string, opts ...*Opti
         return nil, err
     }
 
-    conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+    var conn net.Conn
+    if network == "inproc" {
+        conn, err = dialInproc(address, opt.ConnectTimeout)
+    } else {
+        conn, err = net.DialTimeout(network, address, opt.ConnectTimeout)
+    }
     if err != nil {
         return nil, err
     }
@@ -225,7 +266,16 @@ func dialTimeout(newCliFun newClientFunc, network, address string, opts ...*Opti
 
     ch := make(chan clientResult)
     go func() {
-        client, err := newCliFun(conn, opt)
+        c := conn
+        if opt.TLSConfig != nil {
+            tlsConn, err := clientTLS(conn, address, opt.TLSConfig)
+            if err != nil {
+                ch <- clientResult{err: err}
+                return
+            }
+            c = tlsConn
+        }
+        client, err := newCliFun(c, opt)
         ch <- clientResult{client: client, err: err}
     } ()
 
@@ -257,6 +307,12 @@ func (client *Client) send(call *Call) {
     client.header.ServiceMethod = call.ServiceMethod
     client.header.Seq = seq
     client.header.Error = ""
+    client.header.Timeout = 0
+    client.header.Cancel = false
+    client.header.Metadata = call.metadata
+    if !call.deadline.IsZero() && client.info.HasFeature(FeatureTimeout) {
+        client.header.Timeout = remaining(call.deadline)
+    }
 
     if err := client.cc.Write(&client.header, call.Args); err != nil {
         call := client.removeCall(seq)
@@ -268,6 +324,40 @@ func (client *Client) send(call *Call) {
 }
 
 
+// 通知服务端取消序号为 seq 的请求，服务端不支持取消时不发送，旧版本的服务端会把取消消息当作错误的请求
+func (client *Client) sendCancel(seq uint64) {
+    if !client.info.HasFeature(FeatureCancel) {
+        return
+    }
+    client.sending.Lock()
+    defer client.sending.Unlock()
+
+    client.header.ServiceMethod = ""
+    client.header.Seq = seq
+    client.header.Error = ""
+    client.header.Timeout = 0
+    client.header.Cancel = true
+    client.header.Metadata = nil
+
+    if err := client.cc.Write(&client.header, invalidRequest); err != nil {
+        log.Println("rpc client: send cancel error:", err)
+    }
+}
+
+
+// 距离截止时间的剩余时间，已经超时的也至少为 1 纳秒，服务端会立即超时
+func remaining(deadline time.Time) int64 {
+    if d := time.Until(deadline); d > 0 {
+        return int64(d)
+    }
+    return 1
+}
+
+
+// 异步调用，结果通过 done 返回
+// 没有拦截器时直接发送请求，返回的 Call.Seq 为请求的序号；有拦截器时整条调用链在后台以
+// context.Background() 执行，返回的 Call 只用于接收结果，Seq 为 0，不能被取消，也不能和实际的请求对应。
+// 需要超时、取消或者元数据时在 goroutine 中使用 Call
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
     if done == nil {
         done = make(chan *Call, 10)
@@ -281,18 +371,52 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
         Reply: reply,
         Done: done,
     }
-    client.send(call)
+    if len(client.interceptors) == 0 {
+        client.send(call)
+        return call
+    }
 
+    // 有拦截器时异步执行整条调用链
+    go func() {
+        call.Error = client.invoke(context.Background(), serviceMethod, args, reply)
+        call.done()
+    } ()
     return call
 }
 
 
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-    call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+    return client.invoke(ctx, serviceMethod, args, reply)
+}
+
+
+func (client *Client) invoke(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+    // 拦截器可以通过 header.Metadata 读取和修改将要发送的元数据
+    header := &codec.Header{ServiceMethod: serviceMethod, Metadata: OutgoingMetadata(ctx)}
+    return chainInvoker(client.interceptors, client.call)(ctx, header, args, reply)
+}
+
+
+// 调用链的末端，发送请求并等待响应
+func (client *Client) call(ctx context.Context, header *codec.Header, args, reply interface{}) error {
+    call := &Call {
+        ServiceMethod: header.ServiceMethod,
+        Args: args,
+        Reply: reply,
+        Done: make(chan *Call, 1),
+        metadata: header.Metadata,
+    }
+    if deadline, ok := ctx.Deadline(); ok {
+        call.deadline = deadline
+    }
+    client.send(call)
+
     select {
     case <-ctx.Done():
-        client.removeCall(call.Seq)
-        return errors.New("rpc client: call failed: " + ctx.Err().Error())
+        if client.removeCall(call.Seq) != nil {
+            client.sendCancel(call.Seq)
+        }
+        return NewError(CodeOf(ctx.Err()), "rpc client: call failed: " + ctx.Err().Error())
     case call := <-call.Done:
         return call.Error
     }
@@ -319,8 +443,10 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 }
 
 
+// rpcAddr 的格式为 protocol@addr，如 tcp@10.0.0.1:9999, http@10.0.0.1:7001, tls@example.com:443,
+// unix@/tmp/geerpc.sock, inproc@foo，addr 中可以包含 @
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
-    parts := strings.Split(rpcAddr, "@")
+    parts := strings.SplitN(rpcAddr, "@", 2)
     if len(parts) != 2 {
         return nil, fmt.Errorf("rpc client error: wrong format '%s', expect protocol@addr", rpcAddr)
     }
@@ -329,7 +455,20 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
     switch protocol {
     case "http":
         return DialHTTP("tcp", addr, opts...)
+    case "tls":
+        // 没有设置 TLSConfig 时使用系统的根证书校验服务端
+        opt, err := parseOptions(opts...)
+        if err != nil {
+            return nil, err
+        }
+        if opt.TLSConfig == nil {
+            tlsOpt := *opt
+            tlsOpt.TLSConfig = &tls.Config{}
+            opt = &tlsOpt
+        }
+        return Dial("tcp", addr, opt)
     default:
+        // tcp, unix 和 inproc 等直接作为 network
         return Dial(protocol, addr, opts...)
     }
 }
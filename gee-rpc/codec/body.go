@@ -0,0 +1,40 @@
+package codec
+
+
+import (
+    "bytes"
+    "encoding/gob"
+    "encoding/json"
+)
+
+
+// 把 body 按编解码方式单独序列化为 []byte，不依赖连接上的编码状态
+// 流上的消息先以 []byte 发送，接收方的读循环缓存后再由 Recv 解码，未知的编解码方式使用 gob
+func MarshalBody(typ Type, body interface{}) ([]byte, error) {
+    switch typ {
+    case JsonType:
+        return json.Marshal(body)
+    case FrameType:
+        return marshalFrameBody(body)
+    }
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+
+// MarshalBody 的逆操作，body 为 nil 时直接丢弃
+func UnmarshalBody(typ Type, data []byte, body interface{}) error {
+    if body == nil {
+        return nil
+    }
+    switch typ {
+    case JsonType:
+        return json.Unmarshal(data, body)
+    case FrameType:
+        return unmarshalFrameBody(data, body)
+    }
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(body)
+}
@@ -7,6 +7,14 @@ type Header struct {
     ServiceMethod string    // Service.Method, 服务名和方法名
     Seq uint64      // 请求的序号，用来区分不同请求
     Error string    // 错误信息
+    ErrorCode int `json:",omitempty"`     // 错误码，见 geerpc.Code
+    ErrorDetails map[string]string `json:",omitempty"`    // 错误的附加信息
+    Timeout int64   // 客户端剩余的超时时间 (纳秒)，服务端据此计算自己的截止时间，不受两端时钟偏差影响，0 表示不设限
+    Cancel bool     // 取消序号为 Seq 的请求，服务端不回复
+    Stream bool     // 流式调用的消息
+    EOS bool        // 流结束，发送方不会再发送消息
+    Credit uint32 `json:",omitempty"`    // 流量控制，接收方新处理完的消息数，发送方可以再发送同样多的消息
+    Metadata map[string]string `json:",omitempty"`    // 请求的元数据，如 trace id、租户，响应中不携带
 }
 
 
@@ -25,6 +33,7 @@ type Type string
 const (
     GobType Type = "application/gob"
     JsonType Type = "application/json"
+    FrameType Type = "application/x-geerpc-frame"     // 带长度前缀的二进制帧，可以承载 protobuf 等 []byte 数据
 )
 
 var NewCodecFuncMap map[Type]NewCodecFunc
@@ -33,4 +42,6 @@ var NewCodecFuncMap map[Type]NewCodecFunc
 func init() {
     NewCodecFuncMap = make(map[Type]NewCodecFunc)
     NewCodecFuncMap[GobType] = NewGobCodec
+    NewCodecFuncMap[JsonType] = NewJsonCodec
+    NewCodecFuncMap[FrameType] = NewFrameCodec
 }
@@ -0,0 +1,109 @@
+package codec
+
+import (
+    "net"
+    "testing"
+)
+
+
+type testArgs struct {
+    Num1 int
+    Num2 int
+}
+
+
+func TestJsonCodec(test *testing.T) {
+    c1, c2 := net.Pipe()
+    client, server := NewJsonCodec(c1), NewJsonCodec(c2)
+    defer client.Close()
+    defer server.Close()
+
+    go func() {
+        _ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &testArgs{Num1: 1, Num2: 2})
+        _ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, &testArgs{Num1: 3, Num2: 4})
+    } ()
+
+    var header Header
+    if err := server.ReadHeader(&header); err != nil {
+        test.Fatal("read header error:", err)
+    }
+    if header.ServiceMethod != "Foo.Sum" || header.Seq != 1 {
+        test.Fatalf("unexpected header %+v", header)
+    }
+    // 未知请求的 body 直接丢弃，不影响后续消息
+    if err := server.ReadBody(nil); err != nil {
+        test.Fatal("discard body error:", err)
+    }
+
+    if err := server.ReadHeader(&header); err != nil {
+        test.Fatal("read header error:", err)
+    }
+    var args testArgs
+    if err := server.ReadBody(&args); err != nil {
+        test.Fatal("read body error:", err)
+    }
+    if header.Seq != 2 || args.Num1 != 3 || args.Num2 != 4 {
+        test.Fatalf("unexpected message %+v %+v", header, args)
+    }
+}
+
+
+type rawMessage struct {
+    data []byte
+}
+
+
+func (m *rawMessage) Marshal() ([]byte, error) {
+    return m.data, nil
+}
+
+
+func (m *rawMessage) Unmarshal(data []byte) error {
+    m.data = append([]byte(nil), data...)
+    return nil
+}
+
+
+func TestFrameCodec(test *testing.T) {
+    c1, c2 := net.Pipe()
+    client, server := NewFrameCodec(c1), NewFrameCodec(c2)
+    defer client.Close()
+    defer server.Close()
+
+    go func() {
+        _ = client.Write(&Header{ServiceMethod: "Foo.Skip", Seq: 1}, &testArgs{Num1: 1, Num2: 2})
+        _ = client.Write(&Header{ServiceMethod: "Foo.Raw", Seq: 2}, []byte("raw payload"))
+        _ = client.Write(&Header{ServiceMethod: "Foo.Proto", Seq: 3}, &rawMessage{data: []byte{0x08, 0x96, 0x01}})
+        _ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 4}, &testArgs{Num1: 3, Num2: 4})
+    } ()
+
+    var header Header
+    // 不读取 body 直接读取下一个 header，body 会被跳过
+    if err := server.ReadHeader(&header); err != nil || header.Seq != 1 {
+        test.Fatalf("unexpected header %+v, error %v", header, err)
+    }
+
+    if err := server.ReadHeader(&header); err != nil || header.ServiceMethod != "Foo.Raw" {
+        test.Fatalf("unexpected header %+v, error %v", header, err)
+    }
+    var raw []byte
+    if err := server.ReadBody(&raw); err != nil || string(raw) != "raw payload" {
+        test.Fatalf("unexpected body %q, error %v", raw, err)
+    }
+
+    if err := server.ReadHeader(&header); err != nil || header.ServiceMethod != "Foo.Proto" {
+        test.Fatalf("unexpected header %+v, error %v", header, err)
+    }
+    var msg rawMessage
+    if err := server.ReadBody(&msg); err != nil || len(msg.data) != 3 || msg.data[1] != 0x96 {
+        test.Fatalf("unexpected body %v, error %v", msg.data, err)
+    }
+
+    if err := server.ReadHeader(&header); err != nil || header.Seq != 4 {
+        test.Fatalf("unexpected header %+v, error %v", header, err)
+    }
+    var args testArgs
+    if err := server.ReadBody(&args); err != nil || args.Num1 != 3 || args.Num2 != 4 {
+        test.Fatalf("unexpected body %+v, error %v", args, err)
+    }
+}
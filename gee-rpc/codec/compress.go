@@ -0,0 +1,233 @@
+package codec
+
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "sort"
+    "sync"
+)
+
+
+/*
+压缩在 codec 之下进行，对所有编解码方式都适用:
+内部的 codec 每次 Write 产生的数据 (header + body) 作为一条消息，超过阈值时压缩，按帧发送
+| flags (uint8) | 长度 (uint32) | 数据 |
+flags 为 flagCompressed 时数据是压缩后的。读取时依次解压每一帧，内部的 codec 看到的是连续的原始数据流，
+gob 等有状态的编码不受影响。
+*/
+
+
+const (
+    compressPrefixSize = 5
+    flagCompressed = 1
+    DefaultCompressThreshold = 1024     // 小于该长度的消息不压缩
+)
+
+
+// 压缩算法，需要支持并发调用
+type Compressor interface {
+    Compress([]byte) ([]byte, error)
+    Decompress([]byte) ([]byte, error)
+}
+
+
+var (
+    compressorsMtx sync.RWMutex
+    compressors = map[string]Compressor{"gzip": &gzipCompressor{}}
+)
+
+
+// 注册压缩算法，如 snappy，同名时覆盖
+func RegisterCompressor(name string, c Compressor) {
+    compressorsMtx.Lock()
+    defer compressorsMtx.Unlock()
+    compressors[name] = c
+}
+
+
+func GetCompressor(name string) Compressor {
+    compressorsMtx.RLock()
+    defer compressorsMtx.RUnlock()
+    return compressors[name]
+}
+
+
+// 所有已注册的压缩算法
+func Compressors() []string {
+    compressorsMtx.RLock()
+    defer compressorsMtx.RUnlock()
+
+    names := make([]string, 0, len(compressors))
+    for name := range compressors {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+
+type gzipCompressor struct {
+    writers sync.Pool
+}
+
+
+func (g *gzipCompressor) Compress(data []byte) ([]byte, error) {
+    var buf bytes.Buffer
+    w, ok := g.writers.Get().(*gzip.Writer)
+    if ok {
+        w.Reset(&buf)
+    } else {
+        w = gzip.NewWriter(&buf)
+    }
+    defer g.writers.Put(w)
+
+    if _, err := w.Write(data); err != nil {
+        return nil, err
+    }
+    if err := w.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+
+func (g *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+    r, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return io.ReadAll(io.LimitReader(r, maxFrameSize + 1))
+}
+
+
+type compressCodec struct {
+    Codec                       // 内部的 codec，读写都经过 compressConn
+    conn io.ReadWriteCloser
+    r *bufio.Reader
+    c Compressor
+    threshold int
+    wbuf bytes.Buffer           // 内部 codec 当前写入的消息
+    rbuf bytes.Reader           // 当前帧解压后还没有读取的数据
+}
+
+
+// 在 conn 上按帧压缩，newCodec 为内部的编解码方式，threshold 为 0 时使用 DefaultCompressThreshold
+// 连接的双方需要使用相同的压缩算法，一般在建立连接时协商
+func NewCompressCodec(conn io.ReadWriteCloser, newCodec NewCodecFunc, c Compressor, threshold int) Codec {
+    if threshold <= 0 {
+        threshold = DefaultCompressThreshold
+    }
+    cc := &compressCodec {
+        conn: conn,
+        r: bufio.NewReader(conn),
+        c: c,
+        threshold: threshold,
+    }
+    cc.Codec = newCodec(&compressConn{cc})
+    return cc
+}
+
+
+func (c *compressCodec) Write(header *Header, body interface{}) error {
+    c.wbuf.Reset()
+    if err := c.Codec.Write(header, body); err != nil {
+        return err
+    }
+    if err := c.writeFrame(c.wbuf.Bytes()); err != nil {
+        _ = c.Close()
+        return err
+    }
+    return nil
+}
+
+
+func (c *compressCodec) writeFrame(data []byte) error {
+    var flags uint8
+    if len(data) >= c.threshold {
+        compressed, err := c.c.Compress(data)
+        if err != nil {
+            return err
+        }
+        // 压缩后没有变小时直接发送原始数据
+        if len(compressed) < len(data) {
+            data, flags = compressed, flagCompressed
+        }
+    }
+    if len(data) > maxFrameSize {
+        return fmt.Errorf("rpc codec: message too large: %d", len(data))
+    }
+
+    var prefix [compressPrefixSize]byte
+    prefix[0] = flags
+    binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+    if _, err := c.conn.Write(append(prefix[:], data...)); err != nil {
+        return err
+    }
+    return nil
+}
+
+
+// 读取下一帧并在需要时解压
+func (c *compressCodec) readFrame() error {
+    var prefix [compressPrefixSize]byte
+    if _, err := io.ReadFull(c.r, prefix[:]); err != nil {
+        return err
+    }
+    n := binary.BigEndian.Uint32(prefix[1:])
+    if n > maxFrameSize {
+        return fmt.Errorf("rpc codec: message too large: %d", n)
+    }
+    data := make([]byte, n)
+    if _, err := io.ReadFull(c.r, data); err != nil {
+        return unexpectedEOF(err)
+    }
+
+    if prefix[0] & flagCompressed != 0 {
+        var err error
+        if data, err = c.c.Decompress(data); err != nil {
+            return err
+        }
+        if len(data) > maxFrameSize {
+            return fmt.Errorf("rpc codec: message too large after decompression")
+        }
+    }
+    c.rbuf.Reset(data)
+    return nil
+}
+
+
+func (c *compressCodec) Close() error {
+    return c.conn.Close()
+}
+
+
+// 内部 codec 使用的连接，写入时缓存整条消息，读取时返回解压后的数据
+type compressConn struct {
+    c *compressCodec
+}
+
+
+func (conn *compressConn) Read(p []byte) (int, error) {
+    for conn.c.rbuf.Len() == 0 {
+        if err := conn.c.readFrame(); err != nil {
+            return 0, err
+        }
+    }
+    return conn.c.rbuf.Read(p)
+}
+
+
+func (conn *compressConn) Write(p []byte) (int, error) {
+    return conn.c.wbuf.Write(p)
+}
+
+
+func (conn *compressConn) Close() error {
+    return conn.c.conn.Close()
+}
@@ -0,0 +1,120 @@
+package codec
+
+import (
+    "io"
+    "net"
+    "strings"
+    "sync/atomic"
+    "testing"
+)
+
+
+type testPayload struct {
+    Data string
+}
+
+
+// 统计写入连接的字节数
+type countingConn struct {
+    net.Conn
+    n int64
+}
+
+
+func (c *countingConn) Write(p []byte) (int, error) {
+    atomic.AddInt64(&c.n, int64(len(p)))
+    return c.Conn.Write(p)
+}
+
+
+func newCompressPipe(typ Type, c Compressor) (*countingConn, Codec, Codec) {
+    c1, c2 := net.Pipe()
+    conn := &countingConn{Conn: c1}
+    if c == nil {
+        return conn, NewCodecFuncMap[typ](conn), NewCodecFuncMap[typ](c2)
+    }
+    return conn, NewCompressCodec(conn, NewCodecFuncMap[typ], c, 0), NewCompressCodec(c2, NewCodecFuncMap[typ], c, 0)
+}
+
+
+func TestCompressCodec(test *testing.T) {
+    large := strings.Repeat("geerpc compress ", 1024)
+    for typ := range NewCodecFuncMap {
+        test.Run(string(typ), func(test *testing.T) {
+            conn, client, server := newCompressPipe(typ, GetCompressor("gzip"))
+            defer client.Close()
+            defer server.Close()
+
+            go func() {
+                _ = client.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &testArgs{Num1: 1, Num2: 2})
+                _ = client.Write(&Header{ServiceMethod: "Foo.Skip", Seq: 2}, &testPayload{Data: large})
+                _ = client.Write(&Header{ServiceMethod: "Foo.Echo", Seq: 3}, &testPayload{Data: large})
+            } ()
+
+            var header Header
+            var args testArgs
+            if err := server.ReadHeader(&header); err != nil || header.Seq != 1 {
+                test.Fatalf("unexpected header %+v, error %v", header, err)
+            }
+            if err := server.ReadBody(&args); err != nil || args.Num1 != 1 || args.Num2 != 2 {
+                test.Fatalf("unexpected body %+v, error %v", args, err)
+            }
+
+            // 跳过压缩过的 body 不影响后续消息
+            if err := server.ReadHeader(&header); err != nil || header.Seq != 2 {
+                test.Fatalf("unexpected header %+v, error %v", header, err)
+            }
+            if err := server.ReadBody(nil); err != nil {
+                test.Fatal("discard body error:", err)
+            }
+
+            var payload testPayload
+            if err := server.ReadHeader(&header); err != nil || header.Seq != 3 {
+                test.Fatalf("unexpected header %+v, error %v", header, err)
+            }
+            if err := server.ReadBody(&payload); err != nil || payload.Data != large {
+                test.Fatalf("unexpected body length %d, error %v", len(payload.Data), err)
+            }
+            if n := atomic.LoadInt64(&conn.n); n >= int64(len(large)) {
+                test.Fatalf("expect compressed messages, wrote %d bytes", n)
+            }
+        })
+    }
+}
+
+
+// 比较不同编解码方式压缩前后的吞吐量和实际发送的字节数
+func BenchmarkCompressCodec(b *testing.B) {
+    payload := &testPayload{Data: strings.Repeat("geerpc benchmark payload ", 2048)}
+    for typ := range NewCodecFuncMap {
+        for _, name := range []string{"none", "gzip"} {
+            b.Run(string(typ) + "/" + name, func(b *testing.B) {
+                conn, client, server := newCompressPipe(typ, GetCompressor(name))
+                defer client.Close()
+                defer server.Close()
+
+                go func() {
+                    var header Header
+                    for {
+                        if err := server.ReadHeader(&header); err != nil {
+                            return
+                        }
+                        var p testPayload
+                        if err := server.ReadBody(&p); err != nil {
+                            return
+                        }
+                    }
+                } ()
+
+                b.SetBytes(int64(len(payload.Data)))
+                b.ResetTimer()
+                for i := 0; i < b.N; i++ {
+                    if err := client.Write(&Header{ServiceMethod: "Foo.Echo", Seq: uint64(i)}, payload); err != nil && err != io.ErrClosedPipe {
+                        b.Fatal("write error:", err)
+                    }
+                }
+                b.ReportMetric(float64(atomic.LoadInt64(&conn.n)) / float64(b.N), "wire-B/op")
+            })
+        }
+    }
+}
@@ -0,0 +1,195 @@
+package codec
+
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/gob"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+)
+
+
+/*
+每条消息由定长前缀和两段数据组成:
+| header 长度 (uint32) | body 长度 (uint32) | header (json) | body |
+body 的长度事先可知，因此不需要解码就能跳过 body，代理也可以只解析 header 完成转发
+*/
+
+
+const (
+    framePrefixSize = 8
+    maxFrameSize = 64 << 20     // 单个 header 或 body 的最大长度
+)
+
+
+// 兼容 protobuf 生成代码的序列化接口
+type Marshaler interface {
+    Marshal() ([]byte, error)
+}
+
+
+type Unmarshaler interface {
+    Unmarshal([]byte) error
+}
+
+
+type FrameCodec struct {
+    conn io.ReadWriteCloser
+    r *bufio.Reader
+    buf *bufio.Writer
+    bodyLen uint32      // 当前消息还没有读取的 body 长度
+}
+
+
+func NewFrameCodec(conn io.ReadWriteCloser) Codec {
+    return &FrameCodec {
+        conn: conn,
+        r: bufio.NewReader(conn),
+        buf: bufio.NewWriter(conn),
+    }
+}
+
+
+func (c *FrameCodec) ReadHeader(header *Header) error {
+    // 上一条消息的 body 没有被读取时先跳过
+    if err := c.discardBody(); err != nil {
+        return err
+    }
+
+    var prefix [framePrefixSize]byte
+    if _, err := io.ReadFull(c.r, prefix[:]); err != nil {
+        return err
+    }
+    headerLen := binary.BigEndian.Uint32(prefix[:4])
+    bodyLen := binary.BigEndian.Uint32(prefix[4:])
+    if headerLen > maxFrameSize || bodyLen > maxFrameSize {
+        return fmt.Errorf("rpc codec: frame too large: header %d, body %d", headerLen, bodyLen)
+    }
+
+    data := make([]byte, headerLen)
+    if _, err := io.ReadFull(c.r, data); err != nil {
+        return unexpectedEOF(err)
+    }
+    c.bodyLen = bodyLen
+
+    *header = Header{}
+    return json.Unmarshal(data, header)
+}
+
+
+// body 为 nil 时直接跳过，不做任何解码
+// body 为 *[]byte 时返回原始数据，实现 Unmarshaler 的类型自行解码，其余类型使用 gob 解码
+func (c *FrameCodec) ReadBody(body interface{}) error {
+    if body == nil {
+        return c.discardBody()
+    }
+
+    data := make([]byte, c.bodyLen)
+    c.bodyLen = 0
+    if _, err := io.ReadFull(c.r, data); err != nil {
+        return unexpectedEOF(err)
+    }
+
+    return unmarshalFrameBody(data, body)
+}
+
+
+func unmarshalFrameBody(data []byte, body interface{}) error {
+    switch v := body.(type) {
+    case *[]byte:
+        *v = data
+        return nil
+    case Unmarshaler:
+        return v.Unmarshal(data)
+    }
+    if len(data) == 0 {
+        return nil
+    }
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(body)
+}
+
+
+func (c *FrameCodec) discardBody() error {
+    if c.bodyLen == 0 {
+        return nil
+    }
+    n := c.bodyLen
+    c.bodyLen = 0
+    _, err := c.r.Discard(int(n))
+    return unexpectedEOF(err)
+}
+
+
+func (c *FrameCodec) Write(header *Header, body interface{}) (err error) {
+    defer func() {
+        _ = c.buf.Flush()
+        if err != nil {
+            _ = c.Close()
+        }
+    } ()
+
+    h, err := json.Marshal(header)
+    if err != nil {
+        log.Println("rpc codec: frame error encoding header:", err)
+        return err
+    }
+
+    b, err := marshalFrameBody(body)
+    if err != nil {
+        log.Println("rpc codec: frame error encoding body:", err)
+        return err
+    }
+
+    if len(h) > maxFrameSize || len(b) > maxFrameSize {
+        err = fmt.Errorf("rpc codec: frame too large: header %d, body %d", len(h), len(b))
+        return err
+    }
+
+    var prefix [framePrefixSize]byte
+    binary.BigEndian.PutUint32(prefix[:4], uint32(len(h)))
+    binary.BigEndian.PutUint32(prefix[4:], uint32(len(b)))
+    for _, data := range [][]byte{prefix[:], h, b} {
+        if _, err = c.buf.Write(data); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+
+func marshalFrameBody(body interface{}) ([]byte, error) {
+    switch v := body.(type) {
+    case nil:
+        return nil, nil
+    case []byte:
+        return v, nil
+    case *[]byte:
+        return *v, nil
+    case Marshaler:
+        return v.Marshal()
+    }
+
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+
+func unexpectedEOF(err error) error {
+    if errors.Is(err, io.EOF) {
+        return io.ErrUnexpectedEOF
+    }
+    return err
+}
+
+
+func (c *FrameCodec) Close() error {
+    return c.conn.Close()
+}
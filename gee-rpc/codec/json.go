@@ -0,0 +1,72 @@
+package codec
+
+
+import (
+    "bufio"
+    "encoding/json"
+    "io"
+    "log"
+)
+
+
+type JsonCodec struct {
+    conn io.ReadWriteCloser
+    buf *bufio.Writer
+    dec *json.Decoder
+    enc *json.Encoder
+}
+
+
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+    buf := bufio.NewWriter(conn)
+    return &JsonCodec {
+        conn: conn,
+        buf: buf,
+        dec: json.NewDecoder(conn),
+        enc: json.NewEncoder(buf),
+    }
+}
+
+
+func (c *JsonCodec) ReadHeader(header *Header) error {
+    return c.dec.Decode(header)
+}
+
+
+func (c *JsonCodec) ReadBody(body interface{}) error {
+    if body == nil {
+        // json 不能解码到 nil，读出原始数据后丢弃
+        var discard json.RawMessage
+        return c.dec.Decode(&discard)
+    }
+    return c.dec.Decode(body)
+}
+
+
+func (c *JsonCodec) Write(header *Header, body interface{}) (err error) {
+    defer func() {
+        _ = c.buf.Flush()
+        if err != nil {
+            _ = c.Close()
+        }
+    } ()
+
+    err = c.enc.Encode(header)
+    if err != nil {
+        log.Println("rpc codec: json error encoding header:", err)
+        return err
+    }
+
+    err = c.enc.Encode(body)
+    if err != nil {
+        log.Println("rpc codec: json error encoding body:", err)
+        return err
+    }
+
+    return nil
+}
+
+
+func (c *JsonCodec) Close() error {
+    return c.conn.Close()
+}
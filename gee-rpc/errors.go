@@ -0,0 +1,159 @@
+package geerpc
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "geerpc/codec"
+)
+
+/*
+服务端返回的错误通过 Header.Error、Header.ErrorCode 和 Header.ErrorDetails 传给客户端，客户端还原为 *Error:
+    var rpcErr *geerpc.Error
+    errors.As(err, &rpcErr)             // 取出错误码和 Details
+    errors.Is(err, geerpc.NotFound)     // 按错误码判断
+服务方法返回的普通 error 错误码为 Unknown，需要指定错误码时返回 geerpc.Errorf 等创建的 *Error。
+旧版本的服务端不发送错误码，客户端同样视为 Unknown。
+*/
+
+
+// 错误码，取值和 gRPC 相同，实现了 error 以便用于 errors.Is
+type Code int
+
+
+const (
+    OK Code = iota
+    Canceled
+    Unknown
+    InvalidArgument
+    DeadlineExceeded
+    NotFound
+    AlreadyExists
+    PermissionDenied
+    ResourceExhausted
+    FailedPrecondition
+    Aborted
+    OutOfRange
+    Unimplemented
+    Internal
+    Unavailable
+    DataLoss
+    Unauthenticated
+)
+
+
+var codeNames = [...]string {
+    "OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded", "NotFound", "AlreadyExists",
+    "PermissionDenied", "ResourceExhausted", "FailedPrecondition", "Aborted", "OutOfRange",
+    "Unimplemented", "Internal", "Unavailable", "DataLoss", "Unauthenticated",
+}
+
+
+func (c Code) String() string {
+    if c >= 0 && int(c) < len(codeNames) {
+        return codeNames[c]
+    }
+    return fmt.Sprintf("Code(%d)", int(c))
+}
+
+
+func (c Code) Error() string {
+    return "rpc error: " + c.String()
+}
+
+
+// 带错误码的 RPC 错误，Details 为可选的附加信息，随错误一起传给客户端
+type Error struct {
+    Code Code
+    Message string
+    Details map[string]string
+}
+
+
+func NewError(code Code, msg string) *Error {
+    return &Error{Code: code, Message: msg}
+}
+
+
+func Errorf(code Code, format string, args ...interface{}) *Error {
+    return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+
+// 和原来的字符串错误保持一致，只返回错误信息
+func (e *Error) Error() string {
+    return e.Message
+}
+
+
+// 目标为 Code 时按错误码比较，为 *Error 时比较错误码和错误信息，
+// DeadlineExceeded 和 Canceled 也分别匹配 context 的对应错误
+func (e *Error) Is(target error) bool {
+    switch t := target.(type) {
+    case Code:
+        return e.Code == t
+    case *Error:
+        return e.Code == t.Code && e.Message == t.Message
+    }
+    switch target {
+    case context.DeadlineExceeded:
+        return e.Code == DeadlineExceeded
+    case context.Canceled:
+        return e.Code == Canceled
+    }
+    return false
+}
+
+
+// 返回 err 的错误码，nil 为 OK，context 的错误对应 DeadlineExceeded 和 Canceled，其余为 Unknown
+func CodeOf(err error) Code {
+    if err == nil {
+        return OK
+    }
+    var rpcErr *Error
+    switch {
+    case errors.As(err, &rpcErr):
+        return rpcErr.Code
+    case errors.Is(err, context.DeadlineExceeded):
+        return DeadlineExceeded
+    case errors.Is(err, context.Canceled):
+        return Canceled
+    }
+    return Unknown
+}
+
+
+// 换一个实例或者稍后重试可能成功的错误: 连接和网络错误，以及 Unavailable、ResourceExhausted、Aborted
+// 其余服务端返回的错误和 context 结束都不应重试
+func Retryable(err error) bool {
+    if err == nil {
+        return false
+    }
+    var rpcErr *Error
+    if errors.As(err, &rpcErr) {
+        return rpcErr.Code == Unavailable || rpcErr.Code == ResourceExhausted || rpcErr.Code == Aborted
+    }
+    return !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled)
+}
+
+
+// 将服务端的错误写入响应的 header
+func setHeaderError(header *codec.Header, err error) {
+    header.Error = err.Error()
+    header.ErrorCode = int(CodeOf(err))
+    header.ErrorDetails = nil
+    var rpcErr *Error
+    if errors.As(err, &rpcErr) {
+        header.ErrorDetails = rpcErr.Details
+    }
+}
+
+
+// 从响应的 header 还原服务端的错误，旧版本的服务端没有错误码，视为 Unknown
+func headerError(header *codec.Header) *Error {
+    code := Code(header.ErrorCode)
+    if code == OK {
+        code = Unknown
+    }
+    return &Error{Code: code, Message: header.Error, Details: header.ErrorDetails}
+}
@@ -0,0 +1,70 @@
+package geerpc
+
+import (
+    "context"
+    "errors"
+    "geerpc/codec"
+    "testing"
+    "time"
+)
+
+
+func (foo Foo) Lookup(args Args, reply *int) error {
+    if args.Num1 < 0 {
+        return &Error{Code: NotFound, Message: "no such user: 100%s", Details: map[string]string{"id": "-1"}}
+    }
+    return errors.New("plain error")
+}
+
+
+func TestStructuredErrors(test *testing.T) {
+    addr := startTestServer(test)
+    for typ := range codec.NewCodecFuncMap {
+        client, err := Dial("tcp", addr, &Option{CodecType: typ})
+        if err != nil {
+            test.Fatal("dial error:", err)
+        }
+
+        var reply int
+        err = client.Call(context.Background(), "Foo.Lookup", &Args{Num1: -1}, &reply)
+        var rpcErr *Error
+        if !errors.As(err, &rpcErr) || rpcErr.Code != NotFound || rpcErr.Details["id"] != "-1" {
+            test.Fatalf("%s: unexpected error %#v", typ, err)
+        }
+        // 错误信息原样返回，% 不会被当作格式符
+        if !errors.Is(err, NotFound) || err.Error() != "no such user: 100%s" {
+            test.Fatalf("%s: unexpected error %v", typ, err)
+        }
+
+        err = client.Call(context.Background(), "Foo.Lookup", &Args{Num1: 1}, &reply)
+        if CodeOf(err) != Unknown || err.Error() != "plain error" || Retryable(err) {
+            test.Fatalf("%s: unexpected error %v", typ, err)
+        }
+
+        err = client.Call(context.Background(), "Foo.Missing", &Args{}, &reply)
+        if !errors.Is(err, NotFound) {
+            test.Fatalf("%s: expect NotFound, got %v", typ, err)
+        }
+        _ = client.Close()
+    }
+
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+    defer cancel()
+    var reply int
+    err = client.Call(ctx, "Foo.Block", &Args{Num1: 200}, &reply)
+    if !errors.Is(err, DeadlineExceeded) || !errors.Is(err, context.DeadlineExceeded) || Retryable(err) {
+        test.Fatal("expect deadline exceeded, got", err)
+    }
+
+    if !Retryable(ErrServerShutdown) || !Retryable(ErrShutdown) || Retryable(NewError(InvalidArgument, "bad")) {
+        test.Fatal("unexpected retryable result")
+    }
+    if !errors.Is(NewError(Unavailable, ErrServerShutdown.Message), ErrServerShutdown) {
+        test.Fatal("errors with the same code and message should match")
+    }
+}
@@ -0,0 +1,118 @@
+package geerpc
+
+import (
+    "errors"
+    "net"
+    "sync"
+    "time"
+)
+
+/*
+进程内的传输，基于 net.Pipe，不经过网络，适合在单元测试中调用注册在 Server 上的服务:
+
+    listener, _ := geerpc.ListenInproc("foo")
+    go server.Accept(listener)
+    client, _ := geerpc.XDial("inproc@foo")
+*/
+
+
+var (
+    inprocMtx sync.Mutex
+    inprocListeners = make(map[string]*inprocListener)
+)
+
+
+type inprocAddr string
+
+
+func (addr inprocAddr) Network() string {
+    return "inproc"
+}
+
+
+func (addr inprocAddr) String() string {
+    return string(addr)
+}
+
+
+type inprocListener struct {
+    name string
+    conns chan net.Conn
+    done chan struct{}
+    once sync.Once
+}
+
+
+var _ net.Listener = (*inprocListener)(nil)
+
+
+// 以 name 注册一个进程内的 listener，同名的 listener 关闭前不能重复注册
+func ListenInproc(name string) (net.Listener, error) {
+    inprocMtx.Lock()
+    defer inprocMtx.Unlock()
+
+    if _, ok := inprocListeners[name]; ok {
+        return nil, errors.New("rpc inproc: address already in use: " + name)
+    }
+    l := &inprocListener {
+        name: name,
+        conns: make(chan net.Conn),
+        done: make(chan struct{}),
+    }
+    inprocListeners[name] = l
+    return l, nil
+}
+
+
+func (l *inprocListener) Accept() (net.Conn, error) {
+    select {
+    case conn := <-l.conns:
+        return conn, nil
+    case <-l.done:
+        return nil, net.ErrClosed
+    }
+}
+
+
+func (l *inprocListener) Close() error {
+    l.once.Do(func() {
+        close(l.done)
+        inprocMtx.Lock()
+        delete(inprocListeners, l.name)
+        inprocMtx.Unlock()
+    })
+    return nil
+}
+
+
+func (l *inprocListener) Addr() net.Addr {
+    return inprocAddr(l.name)
+}
+
+
+// 连接到进程内名为 name 的 listener，timeout 为 0 时一直等待 Accept
+func dialInproc(name string, timeout time.Duration) (net.Conn, error) {
+    inprocMtx.Lock()
+    l := inprocListeners[name]
+    inprocMtx.Unlock()
+    if l == nil {
+        return nil, errors.New("rpc inproc: no listener on " + name)
+    }
+
+    var expire <-chan time.Time
+    if timeout > 0 {
+        t := time.NewTimer(timeout)
+        defer t.Stop()
+        expire = t.C
+    }
+
+    client, server := net.Pipe()
+    select {
+    case l.conns <- server:
+        return client, nil
+    case <-l.done:
+        return nil, errors.New("rpc inproc: listener closed: " + name)
+    case <-expire:
+        return nil, errors.New("rpc inproc: dial timeout: " + name)
+    }
+}
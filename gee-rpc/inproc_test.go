@@ -0,0 +1,82 @@
+package geerpc
+
+import (
+    "context"
+    "net"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+
+func TestInproc(test *testing.T) {
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    listener, err := ListenInproc("foo")
+    if err != nil {
+        test.Fatal("listen error:", err)
+    }
+    if _, err := ListenInproc("foo"); err == nil {
+        test.Fatal("duplicate inproc name should be rejected")
+    }
+    go server.Accept(listener)
+
+    client, err := XDial("inproc@foo")
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    for i := 0; i < 3; i++ {
+        var reply int
+        if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply); err != nil || reply != i + 1 {
+            test.Fatalf("expect %d, got %d, error %v", i + 1, reply, err)
+        }
+    }
+
+    // 流和 Shutdown 同样可用
+    stream, err := client.NewStream(context.Background(), "Foo.Count", &Args{Num1: 3})
+    if err != nil {
+        test.Fatal("new stream error:", err)
+    }
+    var n int
+    for err = stream.Recv(&n); err == nil; err = stream.Recv(&n) {
+    }
+    if n != 2 {
+        test.Fatal("expect the last message to be 2, got", n)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if err := server.Shutdown(ctx); err != nil {
+        test.Fatal("shutdown error:", err)
+    }
+    if _, err := XDial("inproc@foo"); err == nil {
+        test.Fatal("dial after shutdown should fail")
+    }
+}
+
+
+func TestUnixSocket(test *testing.T) {
+    path := filepath.Join(test.TempDir(), "gee@rpc.sock")
+    listener, err := net.Listen("unix", path)
+    if err != nil {
+        test.Skip("unix socket is not supported:", err)
+    }
+    defer listener.Close()
+
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    go server.Accept(listener)
+
+    client, err := XDial("unix@" + path)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    var reply int
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+}
@@ -0,0 +1,73 @@
+package geerpc
+
+import (
+    "context"
+    "geerpc/codec"
+    "log"
+    "time"
+)
+
+
+// 服务端处理函数，链的末端调用注册的服务方法
+type Handler func(ctx context.Context, header *codec.Header, argv, replyv interface{}) error
+
+// 服务端拦截器，调用 next 继续执行后续的拦截器，不调用则直接返回结果
+type ServerInterceptor func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error
+
+
+// 客户端调用函数，链的末端将请求发送给服务端并等待响应
+type Invoker func(ctx context.Context, header *codec.Header, args, reply interface{}) error
+
+// 客户端拦截器，调用 next 继续执行后续的拦截器
+type ClientInterceptor func(ctx context.Context, header *codec.Header, args, reply interface{}, next Invoker) error
+
+
+// 添加服务端拦截器，按添加顺序执行，需要在开始服务前调用
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+    server.interceptors = append(server.interceptors, interceptors...)
+}
+
+
+// 添加客户端拦截器，按添加顺序执行，需要在发起调用前调用
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+    client.interceptors = append(client.interceptors, interceptors...)
+}
+
+
+func chainHandler(interceptors []ServerInterceptor, handler Handler) Handler {
+    for i := len(interceptors) - 1; i >= 0; i-- {
+        interceptor, next := interceptors[i], handler
+        handler = func(ctx context.Context, header *codec.Header, argv, replyv interface{}) error {
+            return interceptor(ctx, header, argv, replyv, next)
+        }
+    }
+    return handler
+}
+
+
+func chainInvoker(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+    for i := len(interceptors) - 1; i >= 0; i-- {
+        interceptor, next := interceptors[i], invoker
+        invoker = func(ctx context.Context, header *codec.Header, args, reply interface{}) error {
+            return interceptor(ctx, header, args, reply, next)
+        }
+    }
+    return invoker
+}
+
+
+// 记录每个请求的处理耗时和错误
+func Logger() ServerInterceptor {
+    return func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error {
+        t := time.Now()
+
+        err := next(ctx, header, argv, replyv)
+
+        if err != nil {
+            log.Printf("rpc server: %s seq %d in %v, error: %v", header.ServiceMethod, header.Seq, time.Since(t), err)
+        } else {
+            log.Printf("rpc server: %s seq %d in %v", header.ServiceMethod, header.Seq, time.Since(t))
+        }
+        return err
+    }
+}
@@ -27,8 +27,12 @@ func (foo Foo) Sum(args Args, reply *int) error {
 }
 
 
-func (foo Foo) Sleep(args Args, reply *int) error {
-    time.Sleep(time.Second * time.Duration(args.Num1))
+func (foo Foo) Sleep(ctx context.Context, args Args, reply *int) error {
+    select {
+    case <-time.After(time.Second * time.Duration(args.Num1)):
+    case <-ctx.Done():
+        return ctx.Err()
+    }
     *reply = args.Num1 + args.Num2
     return nil
 }
@@ -42,7 +46,7 @@ func startRegistry(wg *sync.WaitGroup) {
 }
 
 
-func startServer(registryAddr string, wg *sync.WaitGroup) {
+func startServer(registryAddr string, wg *sync.WaitGroup, servers chan *geerpc.Server) {
     listener, err := net.Listen("tcp", ":0")
     if err != nil {
         log.Fatal("network error:", err)
@@ -54,7 +58,16 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
         log.Fatal("register error:", err)
     }
 
-    registry.Heartbeat(registryAddr, "tcp@" + listener.Addr().String(), 0)
+    addr := "tcp@" + listener.Addr().String()
+    stop := registry.HeartbeatServer(registryAddr, &registry.ServerItem {
+        Addr: addr,
+        Services: server.Services(),
+    }, 0)
+    server.RegisterOnShutdown(func() {
+        stop()
+        _ = registry.Deregister(registryAddr, addr)
+    })
+    servers <- server
     wg.Done()
 
     server.Accept(listener)
@@ -113,8 +126,9 @@ func broadcast(registryAddr string) {
 
             foo(xc, context.Background(), "broadcast", "Foo.Sum", &Args{Num1: i, Num2: i * i})
 
-            ctx, _ := context.WithTimeout(context.Background(), time.Second * 2)
+            ctx, cancel := context.WithTimeout(context.Background(), time.Second * 2)
             foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
+            cancel()
         } (i)
     }
     wg.Wait()
@@ -130,13 +144,22 @@ func main() {
 
     time.Sleep(time.Second)
 
+    servers := make(chan *geerpc.Server, 2)
     wg.Add(2)
-    go startServer(registryAddr, &wg)
-    go startServer(registryAddr, &wg)
+    go startServer(registryAddr, &wg, servers)
+    go startServer(registryAddr, &wg, servers)
     wg.Wait()
 
     time.Sleep(time.Second)
 
     call(registryAddr)
     broadcast(registryAddr)
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+    defer cancel()
+    for i := 0; i < 2; i++ {
+        if err := (<-servers).Shutdown(ctx); err != nil {
+            log.Println("shutdown error:", err)
+        }
+    }
 }
@@ -0,0 +1,61 @@
+package geerpc
+
+import "context"
+
+/*
+请求的元数据随 codec.Header 发送，如 trace id、租户等:
+客户端通过 WithMetadata 在 context 中附加，拦截器也可以直接修改 header.Metadata；
+服务端通过 IncomingMetadata 在服务方法和拦截器中读取。
+*/
+
+
+type outgoingMetadataKey struct{}
+
+type incomingMetadataKey struct{}
+
+
+// 为之后通过 ctx 发起的调用附加元数据，和 ctx 中已有的元数据合并，同名时覆盖
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+    merged := OutgoingMetadata(ctx)
+    if merged == nil {
+        merged = make(map[string]string, len(md))
+    }
+    for k, v := range md {
+        merged[k] = v
+    }
+    return context.WithValue(ctx, outgoingMetadataKey{}, merged)
+}
+
+
+// 客户端 ctx 中将要发送的元数据，返回副本，修改不影响 ctx
+func OutgoingMetadata(ctx context.Context) map[string]string {
+    md, _ := ctx.Value(outgoingMetadataKey{}).(map[string]string)
+    return copyMetadata(md)
+}
+
+
+// 服务端 ctx 中客户端发来的元数据，返回副本，没有时为 nil
+func IncomingMetadata(ctx context.Context) map[string]string {
+    md, _ := ctx.Value(incomingMetadataKey{}).(map[string]string)
+    return copyMetadata(md)
+}
+
+
+func withIncomingMetadata(ctx context.Context, md map[string]string) context.Context {
+    if len(md) == 0 {
+        return ctx
+    }
+    return context.WithValue(ctx, incomingMetadataKey{}, md)
+}
+
+
+func copyMetadata(md map[string]string) map[string]string {
+    if md == nil {
+        return nil
+    }
+    c := make(map[string]string, len(md))
+    for k, v := range md {
+        c[k] = v
+    }
+    return c
+}
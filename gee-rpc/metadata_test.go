@@ -0,0 +1,66 @@
+package geerpc
+
+import (
+    "context"
+    "geerpc/codec"
+    "sync"
+    "testing"
+)
+
+
+func (foo Foo) Tenant(ctx context.Context, args Args, reply *string) error {
+    md := IncomingMetadata(ctx)
+    *reply = md["tenant"] + "/" + md["trace"] + "/" + md["client"]
+    return nil
+}
+
+
+func TestMetadata(test *testing.T) {
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    var seen string
+    var mtx sync.Mutex
+    server.Use(func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error {
+        mtx.Lock()
+        seen = header.Metadata["trace"]
+        mtx.Unlock()
+        return next(ctx, header, argv, replyv)
+    })
+    addr := serveTestServer(test, server)
+
+    for typ := range codec.NewCodecFuncMap {
+        client, err := Dial("tcp", addr, &Option{CodecType: typ})
+        if err != nil {
+            test.Fatal("dial error:", err)
+        }
+        client.Use(func(ctx context.Context, header *codec.Header, args, reply interface{}, next Invoker) error {
+            if header.Metadata != nil {
+                header.Metadata["client"] = "interceptor"
+            }
+            return next(ctx, header, args, reply)
+        })
+
+        ctx := WithMetadata(context.Background(), map[string]string{"tenant": "acme", "trace": "1"})
+        ctx = WithMetadata(ctx, map[string]string{"trace": "2"})
+        var reply string
+        if err := client.Call(ctx, "Foo.Tenant", &Args{}, &reply); err != nil || reply != "acme/2/interceptor" {
+            test.Fatalf("%s: unexpected reply %q, error %v", typ, reply, err)
+        }
+        mtx.Lock()
+        if seen != "2" {
+            test.Fatalf("%s: server interceptor saw trace %q", typ, seen)
+        }
+        mtx.Unlock()
+        // 拦截器修改的是副本，ctx 中的元数据不变
+        if _, ok := OutgoingMetadata(ctx)["client"]; ok {
+            test.Fatal("outgoing metadata in ctx should not be modified")
+        }
+
+        // 之后没有元数据的调用不会带上之前的元数据
+        if err := client.Call(context.Background(), "Foo.Tenant", &Args{}, &reply); err != nil || reply != "//" {
+            test.Fatalf("%s: unexpected reply %q, error %v", typ, reply, err)
+        }
+        _ = client.Close()
+    }
+}
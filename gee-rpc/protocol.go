@@ -0,0 +1,151 @@
+package geerpc
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "geerpc/codec"
+    "io"
+    "net"
+    "sort"
+    "time"
+)
+
+/*
+协议版本:
+0   旧版本，客户端发送 Option 后直接开始发送请求，服务端不回复
+1   服务端读取 Option 后回复 ServerInfo，包含协商后的版本、支持的编解码方式、压缩算法和特性，
+    认证失败等错误也通过回复返回。客户端请求的压缩算法服务端支持时，回复之后双方按帧压缩
+
+服务端根据 Option.Version 决定是否回复，兼容旧版本的客户端。
+客户端在 Option.AckTimeout 内没有收到回复则认为服务端是旧版本，兼容滚动升级期间的旧服务端。
+客户端只使用服务端声明支持的特性，对旧版本的服务端不发送超时时间和取消消息，也不能建立流。
+*/
+
+
+const ProtocolVersion = 1
+
+
+// 服务端支持的特性
+const (
+    FeatureTimeout = "timeout"      // Header.Timeout 传递剩余的超时时间
+    FeatureCancel = "cancel"        // Header.Cancel 取消请求
+    FeatureStream = "stream"        // 流式调用
+)
+
+
+var serverFeatures = []string{FeatureTimeout, FeatureCancel, FeatureStream}
+
+
+// 服务端对 Option 的回复
+type ServerInfo struct {
+    Version int                 // 协商后的协议版本，旧版本的服务端为 0
+    Codecs []codec.Type
+    Compressions []string       // 支持的压缩算法
+    Compression string          // 协商后使用的压缩算法，为空时不压缩
+    Features []string
+}
+
+
+// 是否支持某个特性，旧版本的服务端没有回复，不支持任何特性
+func (info *ServerInfo) HasFeature(feature string) bool {
+    for _, f := range info.Features {
+        if f == feature {
+            return true
+        }
+    }
+    return false
+}
+
+
+type handshakeReply struct {
+    ServerInfo
+    Error string
+    ErrorCode int `json:",omitempty"`    // 和 Header.ErrorCode 相同，旧版本的服务端不发送
+}
+
+
+func (server *Server) serverInfo(version int) ServerInfo {
+    if version > ProtocolVersion {
+        version = ProtocolVersion
+    }
+    codecs := make([]codec.Type, 0, len(codec.NewCodecFuncMap))
+    for typ := range codec.NewCodecFuncMap {
+        codecs = append(codecs, typ)
+    }
+    sort.Slice(codecs, func(i, j int) bool {
+        return codecs[i] < codecs[j]
+    })
+    return ServerInfo {
+        Version: version,
+        Codecs: codecs,
+        Compressions: codec.Compressors(),
+        Features: serverFeatures,
+    }
+}
+
+
+// 发送 Option 并等待服务端的回复，Credentials 不为空时生成认证信息
+func handshake(conn net.Conn, opt *Option) (*ServerInfo, error) {
+    sendOpt := *opt
+    if sendOpt.Version == 0 {
+        sendOpt.Version = ProtocolVersion
+    }
+    if opt.Compression != "" && codec.GetCompressor(opt.Compression) == nil {
+        return nil, fmt.Errorf("unknown compression %s", opt.Compression)
+    }
+    if sendOpt.Version < 0 {
+        sendOpt.Compression = ""    // 旧版本协议无法确认服务端是否支持压缩
+    }
+    if opt.Credentials != nil {
+        auth, err := opt.Credentials.Auth()
+        if err != nil {
+            return nil, err
+        }
+        sendOpt.Auth = auth
+    }
+    if err := json.NewEncoder(conn).Encode(&sendOpt); err != nil {
+        return nil, err
+    }
+    if sendOpt.Version < 0 {
+        return &ServerInfo{}, nil      // 按旧版本协议连接，不等待回复
+    }
+
+    // 回复之后服务端在收到请求前不会再发送数据，json.Decoder 不会多读
+    r := &countingReader{r: conn}
+    if opt.AckTimeout > 0 {
+        _ = conn.SetReadDeadline(time.Now().Add(opt.AckTimeout))
+        defer conn.SetReadDeadline(time.Time{})
+    }
+    var reply handshakeReply
+    if err := json.NewDecoder(r).Decode(&reply); err != nil {
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() && r.n == 0 {
+            return &ServerInfo{}, nil       // 没有收到任何回复，是旧版本的服务端
+        }
+        return nil, err
+    }
+    if reply.Error != "" {
+        return nil, headerError(&codec.Header{Error: reply.Error, ErrorCode: reply.ErrorCode})
+    }
+    return &reply.ServerInfo, nil
+}
+
+
+type countingReader struct {
+    r io.Reader
+    n int
+}
+
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.r.Read(p)
+    c.n += n
+    return n, err
+}
+
+
+// 返回建立连接时服务端回复的信息
+func (client *Client) ServerInfo() ServerInfo {
+    return *client.info
+}
@@ -0,0 +1,192 @@
+package geerpc
+
+import (
+    "context"
+    "encoding/json"
+    "geerpc/codec"
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+
+// 模拟没有协商的旧版本服务端: 读取 Option 后不回复，按原来的方式处理请求，
+// 找不到服务时不读取 body 直接回复错误，收到取消消息会导致后续的消息错位
+// 返回地址和收到的新特性字段的次数
+func serveBaselineServer(test *testing.T) (string, *int32) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        test.Fatal("network error:", err)
+    }
+    test.Cleanup(func() {
+        _ = listener.Close()
+    })
+    violations := new(int32)
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            var opt Option
+            if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+                _ = conn.Close()
+                continue
+            }
+            go serveBaselineConn(codec.NewCodecFuncMap[opt.CodecType](conn), violations)
+        }
+    } ()
+    return listener.Addr().String(), violations
+}
+
+
+func serveBaselineConn(cc codec.Codec, violations *int32) {
+    defer cc.Close()
+    var sending sync.Mutex
+    reply := func(header *codec.Header, body interface{}) {
+        sending.Lock()
+        defer sending.Unlock()
+        _ = cc.Write(header, body)
+    }
+    for {
+        var header codec.Header
+        if err := cc.ReadHeader(&header); err != nil {
+            return
+        }
+        if header.Timeout != 0 || header.Cancel || header.Stream {
+            atomic.AddInt32(violations, 1)
+        }
+        if header.ServiceMethod != "Foo.Sum" && header.ServiceMethod != "Foo.Block" {
+            header.Error = "rpc server: can't find service " + header.ServiceMethod
+            reply(&header, invalidRequest)
+            continue
+        }
+        var args Args
+        if err := cc.ReadBody(&args); err != nil {
+            return
+        }
+        go func(header codec.Header) {
+            if header.ServiceMethod == "Foo.Block" {
+                time.Sleep(time.Millisecond * time.Duration(args.Num1))
+            }
+            reply(&header, args.Num1 + args.Num2)
+        } (header)
+    }
+}
+
+
+func TestProtocolNegotiation(test *testing.T) {
+    addr := startTestServer(test)
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    info := client.ServerInfo()
+    if info.Version != ProtocolVersion || len(info.Codecs) != 3 || !info.HasFeature(FeatureStream) || info.HasFeature("unknown") {
+        test.Fatalf("unexpected server info %+v", info)
+    }
+
+    // 旧版本的客户端不读取回复
+    legacy, err := Dial("tcp", addr, &Option{Version: -1})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer legacy.Close()
+    var reply int
+    if err := legacy.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+
+    // 旧版本的服务端不回复，超时后按旧版本协议继续，不使用任何新特性
+    legacyAddr, violations := serveBaselineServer(test)
+    client2, err := Dial("tcp", legacyAddr, &Option{AckTimeout: time.Millisecond * 100})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client2.Close()
+    if info := client2.ServerInfo(); info.Version != 0 || info.HasFeature(FeatureCancel) || info.HasFeature(FeatureStream) {
+        test.Fatalf("unexpected legacy server info %+v", info)
+    }
+    if _, err := client2.NewStream(context.Background(), "Foo.Count", &Args{}); err == nil {
+        test.Fatal("streams should not be used with a legacy server")
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+    if err := client2.Call(ctx, "Foo.Block", &Args{Num1: 200}, &reply); err == nil {
+        test.Fatal("expect timeout")
+    }
+    cancel()
+    // 没有发送取消消息，连接上之后的调用不受影响
+    if err := client2.Call(context.Background(), "Foo.Sum", &Args{Num1: 2, Num2: 2}, &reply); err != nil || reply != 4 {
+        test.Fatalf("expect 4, got %d, error %v", reply, err)
+    }
+    if n := atomic.LoadInt32(violations); n != 0 {
+        test.Fatal("legacy server received new protocol fields", n, "times")
+    }
+
+    // 不设置 AckTimeout 时使用默认值，同样可以连接旧版本的服务端
+    for _, opts := range [][]*Option{nil, {{}}} {
+        client3, err := Dial("tcp", legacyAddr, opts...)
+        if err != nil {
+            test.Fatal("dial error:", err)
+        }
+        if err := client3.Call(context.Background(), "Foo.Sum", &Args{Num1: 3, Num2: 4}, &reply); err != nil || reply != 7 {
+            test.Fatalf("expect 7, got %d, error %v", reply, err)
+        }
+        _ = client3.Close()
+    }
+
+    var foo Foo
+
+    // 需要认证时旧版本的客户端无法建立连接
+    server := NewServer()
+    _ = server.Register(&foo)
+    server.SetAuthenticator(TokenAuthenticator(map[string]string{"t": "alice"}))
+    legacy2, err := Dial("tcp", serveTestServer(test, server), &Option{Version: -1})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer legacy2.Close()
+    ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if err := legacy2.Call(ctx, "Foo.Sum", &Args{}, &reply); err == nil {
+        test.Fatal("legacy client should be rejected by an authenticating server")
+    }
+}
+
+
+func TestCompressionNegotiation(test *testing.T) {
+    addr := startTestServer(test)
+    for typ := range codec.NewCodecFuncMap {
+        client, err := Dial("tcp", addr, &Option{CodecType: typ, Compression: "gzip", CompressThreshold: 1})
+        if err != nil {
+            test.Fatal("dial error:", err)
+        }
+        if info := client.ServerInfo(); info.Compression != "gzip" || len(info.Compressions) == 0 {
+            test.Fatalf("unexpected server info %+v", info)
+        }
+        var reply int
+        if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+            test.Fatalf("%s: expect 3, got %d, error %v", typ, reply, err)
+        }
+        _ = client.Close()
+    }
+
+    if _, err := Dial("tcp", addr, &Option{Compression: "unknown"}); err == nil {
+        test.Fatal("expect error for unknown compression")
+    }
+
+    // 旧版本的服务端不支持压缩，按不压缩继续
+    legacyAddr, _ := serveBaselineServer(test)
+    client, err := Dial("tcp", legacyAddr, &Option{Compression: "gzip", AckTimeout: time.Millisecond * 100})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    var reply int
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 2, Num2: 3}, &reply); err != nil || reply != 5 {
+        test.Fatalf("expect 5, got %d, error %v", reply, err)
+    }
+}
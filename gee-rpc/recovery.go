@@ -0,0 +1,22 @@
+package geerpc
+
+import (
+    "fmt"
+    "runtime"
+    "strings"
+)
+
+
+func trace(msg string) string {
+    var pcs [32]uintptr
+    n := runtime.Callers(3, pcs[:])     // 跳过前三个调用帧，第 0 个是 Callers 本身，第 1 个是 trace，第 2 个是再上一层的 defer func
+
+    var str strings.Builder
+    str.WriteString(msg + "\nTraceback:")
+    for _, pc := range pcs[:n] {
+        fn := runtime.FuncForPC(pc)
+        file, line := fn.FileLine(pc)
+        str.WriteString(fmt.Sprintf("\n\t%s:%d", file, line))
+    }
+    return str.String()
+}
@@ -0,0 +1,135 @@
+package registry
+
+import (
+    "geerpc"
+    "log"
+    "sync"
+    "time"
+)
+
+
+// 注册中心主动探测实例的配置
+type HealthCheck struct {
+    Interval time.Duration      // 探测周期
+    Timeout time.Duration       // 单次探测的超时
+    MaxFailures int             // 连续失败多少次后移除实例
+    Credentials geerpc.Credentials  // ProbeGeeRPC 连接实例时使用，实例设置了 Authenticator 时需要
+    Probe func(addr string, timeout time.Duration) error    // 为 nil 时使用 ProbeGeeRPC
+}
+
+
+var DefaultHealthCheck = &HealthCheck {
+    Interval: time.Second * 10,
+    Timeout: time.Second * 3,
+    MaxFailures: 3,
+}
+
+
+// 通过 geerpc 连接实例，完成 Option 协商即认为实例健康
+func ProbeGeeRPC(addr string, timeout time.Duration) error {
+    return probeGeeRPC(addr, timeout, nil)
+}
+
+
+func probeGeeRPC(addr string, timeout time.Duration, creds geerpc.Credentials) error {
+    client, err := geerpc.XDial(addr, &geerpc.Option{ConnectTimeout: timeout, Credentials: creds})
+    if err != nil {
+        return err
+    }
+    return client.Close()
+}
+
+
+// 复制一份配置，为 0 的字段使用 DefaultHealthCheck 中的值
+func (hc *HealthCheck) withDefaults() *HealthCheck {
+    if hc == nil {
+        hc = DefaultHealthCheck
+    }
+    c := *hc
+    if c.Interval <= 0 {
+        c.Interval = DefaultHealthCheck.Interval
+    }
+    if c.Timeout <= 0 {
+        c.Timeout = DefaultHealthCheck.Timeout
+    }
+    if c.MaxFailures <= 0 {
+        c.MaxFailures = DefaultHealthCheck.MaxFailures
+    }
+    return &c
+}
+
+
+// 定期探测所有实例，连续失败 MaxFailures 次的实例会被移除，返回的 stop 用于停止探测
+// hc 为 nil 时使用 DefaultHealthCheck，hc 中为 0 的字段同样使用默认值
+func (r *GeeRegistry) StartHealthCheck(hc *HealthCheck) (stop func()) {
+    hc = hc.withDefaults()
+    probe := hc.Probe
+    if probe == nil {
+        probe = func(addr string, timeout time.Duration) error {
+            return probeGeeRPC(addr, timeout, hc.Credentials)
+        }
+    }
+
+    done := make(chan struct{})
+    var once sync.Once
+    go func() {
+        t := time.NewTicker(hc.Interval)
+        defer t.Stop()
+        for {
+            select {
+            case <-t.C:
+                r.checkServers(probe, hc)
+            case <-done:
+                return
+            }
+        }
+    } ()
+
+    return func() {
+        once.Do(func() {
+            close(done)
+        })
+    }
+}
+
+
+func (r *GeeRegistry) checkServers(probe func(string, time.Duration) error, hc *HealthCheck) {
+    r.mtx.Lock()
+    addrs := make([]string, 0, len(r.servers))
+    for addr := range r.servers {
+        addrs = append(addrs, addr)
+    }
+    r.mtx.Unlock()
+
+    // 探测可能很慢，不持有锁
+    var wg sync.WaitGroup
+    results := make([]error, len(addrs))
+    for i, addr := range addrs {
+        wg.Add(1)
+        go func(i int, addr string) {
+            defer wg.Done()
+            results[i] = probe(addr, hc.Timeout)
+        } (i, addr)
+    }
+    wg.Wait()
+
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+    for i, addr := range addrs {
+        s := r.servers[addr]
+        if s == nil {
+            continue
+        }
+        if results[i] == nil {
+            s.failures = 0
+            continue
+        }
+
+        s.failures++
+        log.Printf("rpc registry: health check %s failed (%d/%d): %v", addr, s.failures, hc.MaxFailures, results[i])
+        if s.failures >= hc.MaxFailures {
+            delete(r.servers, addr)
+            r.changed(walDelete, s)
+        }
+    }
+}
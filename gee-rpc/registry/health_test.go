@@ -0,0 +1,97 @@
+package registry
+
+import (
+    "errors"
+    "geerpc"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+
+func TestHeartbeatBackoff(test *testing.T) {
+    // 前两次心跳返回 500
+    var count int32
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        if atomic.AddInt32(&count, 1) <= 2 {
+            w.WriteHeader(http.StatusInternalServerError)
+        }
+    }))
+    defer ts.Close()
+
+    if err := sendHeartbeat(ts.URL, &ServerItem{Addr: "tcp@127.0.0.1:1001"}); err == nil {
+        test.Fatal("heartbeat should report status error")
+    }
+
+    stop := heartbeat(ts.URL, &ServerItem{Addr: "tcp@127.0.0.1:1001"}, time.Hour, time.Millisecond * 10)
+    defer stop()
+    time.Sleep(time.Millisecond * 200)
+    if n := atomic.LoadInt32(&count); n != 3 {
+        test.Fatal("expect heartbeat to retry until success, got attempts:", n)
+    }
+}
+
+
+func TestHealthCheckDefaults(test *testing.T) {
+    r := NewGeeRegistry(defaultTimeout)
+    stop := r.StartHealthCheck(&HealthCheck{})
+    stop()
+
+    hc := (&HealthCheck{}).withDefaults()
+    if hc.Interval != DefaultHealthCheck.Interval || hc.Timeout != DefaultHealthCheck.Timeout || hc.MaxFailures != DefaultHealthCheck.MaxFailures {
+        test.Fatalf("zero fields should use the defaults, got %+v", hc)
+    }
+    // 第一次探测失败不会移除实例
+    r.putServer(&ServerItem{Addr: "tcp@127.0.0.1:1001"})
+    r.checkServers(func(string, time.Duration) error {
+        return errors.New("probe failed")
+    }, hc)
+    if len(r.aliveServers("")) != 1 {
+        test.Fatal("server should not be evicted after a single failure")
+    }
+}
+
+
+func TestHealthCheck(test *testing.T) {
+    listener, _ := net.Listen("tcp", "127.0.0.1:0")
+    defer listener.Close()
+    go geerpc.NewServer().Accept(listener)
+
+    // 需要认证的实例，探测时使用 HealthCheck.Credentials
+    authed, _ := net.Listen("tcp", "127.0.0.1:0")
+    defer authed.Close()
+    server := geerpc.NewServer()
+    server.SetAuthenticator(geerpc.TokenAuthenticator(map[string]string{"probe-token": "registry"}))
+    go server.Accept(authed)
+
+    dead, _ := net.Listen("tcp", "127.0.0.1:0")
+    _ = dead.Close()
+
+    r := NewGeeRegistry(defaultTimeout)
+    alive := "tcp@" + listener.Addr().String()
+    r.putServer(&ServerItem{Addr: alive})
+    r.putServer(&ServerItem{Addr: "tcp@" + authed.Addr().String()})
+    r.putServer(&ServerItem{Addr: "tcp@" + dead.Addr().String()})
+
+    stop := r.StartHealthCheck(&HealthCheck {
+        Interval: time.Millisecond * 20,
+        Timeout: time.Second,
+        MaxFailures: 2,
+        Credentials: geerpc.TokenCredentials("probe-token"),
+    })
+    defer stop()
+    time.Sleep(time.Millisecond * 150)
+
+    servers := r.aliveServers("")
+    if len(servers) != 2 {
+        test.Fatalf("only the unhealthy server should be evicted, got %+v", servers)
+    }
+    for _, s := range servers {
+        if s.Addr != alive && s.Addr != "tcp@" + authed.Addr().String() {
+            test.Fatalf("unhealthy server should be evicted, got %+v", servers)
+        }
+    }
+}
@@ -1,9 +1,13 @@
 package registry
 
 import (
+    "encoding/json"
+    "errors"
     "log"
+    "math/rand"
     "net/http"
     "sort"
+    "strconv"
     "strings"
     "sync"
     "time"
@@ -14,12 +18,35 @@ type GeeRegistry struct {
     timeout time.Duration
     mtx sync.Mutex
     servers map[string]*ServerItem
+    index uint64                // 实例列表的版本号，每次变化加 1
+    epoch string                // 每次启动随机生成，重启后版本号重新计数，客户端据此重新同步
+    notify chan struct{}        // 实例列表变化时关闭，唤醒所有 watch 请求
+    store *store                // 为 nil 时不持久化
+    peers []*peer               // 需要同步注册信息的其他注册中心
 }
 
 
 type ServerItem struct {
     Addr string
+    Services []string       // 实例提供的服务名，如 Foo, Bar，为空表示未声明
+    Version string
+    Weight int              // 负载均衡权重，0 表示默认权重
     start time.Time
+    failures int            // 健康检查连续失败的次数
+}
+
+
+// 实例是否提供指定的服务，未声明服务的实例视为提供所有服务
+func (s *ServerItem) HasService(service string) bool {
+    if service == "" || len(s.Services) == 0 {
+        return true
+    }
+    for _, name := range s.Services {
+        if name == service {
+            return true
+        }
+    }
+    return false
 }
 
 
@@ -33,6 +60,9 @@ func NewGeeRegistry(timeout time.Duration) *GeeRegistry {
     return &GeeRegistry {
         servers: make(map[string]*ServerItem),
         timeout: timeout,
+        index: 1,       // 从 1 开始，index=0 的 watch 请求总是立即返回
+        epoch: strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(rand.Int63(), 36),
+        notify: make(chan struct{}),
     }
 }
 
@@ -40,58 +70,181 @@ func NewGeeRegistry(timeout time.Duration) *GeeRegistry {
 var DefaultGeeRegistry = NewGeeRegistry(defaultTimeout)
 
 
-func (r *GeeRegistry) putServer(addr string) {
+// 添加实例或更新心跳，同时更新实例的元数据
+func (r *GeeRegistry) putServer(item *ServerItem) {
     r.mtx.Lock()
     defer r.mtx.Unlock()
 
-    s := r.servers[addr]
+    s := r.servers[item.Addr]
+    changed := s == nil || !s.sameMeta(item)
     if s == nil {
-        r.servers[addr] = &ServerItem {
-            Addr: addr,
-            start: time.Now(),
+        s = &ServerItem{Addr: item.Addr}
+        r.servers[item.Addr] = s
+    }
+    s.Services = item.Services
+    s.Version = item.Version
+    s.Weight = item.Weight
+    s.start = time.Now()
+    if changed {
+        r.changed(walPut, s)
+    }
+}
+
+
+func (s *ServerItem) sameMeta(item *ServerItem) bool {
+    return s.Version == item.Version && s.Weight == item.Weight &&
+        strings.Join(s.Services, ",") == strings.Join(item.Services, ",")
+}
+
+
+func (r *GeeRegistry) removeServer(addr string) {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+
+    if _, ok := r.servers[addr]; ok {
+        delete(r.servers, addr)
+        r.changed(walDelete, &ServerItem{Addr: addr})
+    }
+}
+
+
+// 实例列表发生变化，需要持有 r.mtx，开启持久化时同时写入 WAL
+// 心跳只更新时间，不会调用 changed
+func (r *GeeRegistry) changed(op string, item *ServerItem) {
+    if r.store != nil {
+        if err := r.store.append(op, item, r.servers); err != nil {
+            log.Println("rpc registry: write wal error:", err)
         }
-    } else {
-        s.start = time.Now()
     }
+    r.wake()
+}
+
+
+// 更新版本号并唤醒所有 watch 请求，需要持有 r.mtx
+func (r *GeeRegistry) wake() {
+    r.index++
+    close(r.notify)
+    r.notify = make(chan struct{})
+}
+
+
+// 返回提供指定服务的可用实例，service 为空时返回所有可用实例
+func (r *GeeRegistry) aliveServers(service string) []*ServerItem {
+    _, alive, _ := r.snapshot(service)
+    return alive
 }
 
 
-func (r *GeeRegistry) aliveServers() []string {
+// 在同一次加锁中返回版本号、可用实例和变化通知，保证三者一致
+func (r *GeeRegistry) snapshot(service string) (uint64, []*ServerItem, chan struct{}) {
     r.mtx.Lock()
     defer r.mtx.Unlock()
 
-    var alive []string
+    var alive []*ServerItem
     for addr, s := range r.servers {
         if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-            alive = append(alive, addr)
+            if s.HasService(service) {
+                item := *s
+                alive = append(alive, &item)
+            }
         } else {    // 删除超时的服务
             delete(r.servers, addr)
+            r.changed(walDelete, s)
         }
     }
-    sort.Strings(alive)
-    return alive
+    sort.Slice(alive, func(i, j int) bool {
+        return alive[i].Addr < alive[j].Addr
+    })
+    return r.index, alive, r.notify
 }
 
 
 func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
     switch req.Method {
     case "GET":
-        // 返回所有可用的服务列表，通过自定义字段 X-Geerpc-Servers 承载
-        w.Header().Set("X-Geerpc-Servers", strings.Join(r.aliveServers(), ","))
+        if req.URL.Query().Get("watch") != "" {
+            r.watch(w, req)
+            return
+        }
+        // 返回可用的服务列表，可以通过 service 参数按服务名筛选
+        // 地址列表通过自定义字段 X-Geerpc-Servers 承载，body 为包含元数据的 json 列表
+        alive := r.aliveServers(req.URL.Query().Get("service"))
+        addrs := make([]string, 0, len(alive))
+        for _, s := range alive {
+            addrs = append(addrs, s.Addr)
+        }
+        w.Header().Set("X-Geerpc-Servers", strings.Join(addrs, ","))
+        w.Header().Set("Content-Type", "application/json")
+        _ = json.NewEncoder(w).Encode(alive)
     case "POST":
         // 添加服务实例或发送心跳，通过自定义字段 X-Geerpc-Server 承载
+        item, err := parseServerItem(req.Header)
+        if err != nil {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        r.putServer(item)
+        if req.Header.Get("X-Geerpc-Replicated") == "" {
+            r.replicate("POST", item)
+        }
+    case "DELETE":
+        // 服务实例主动注销，通过自定义字段 X-Geerpc-Server 承载
         addr := req.Header.Get("X-Geerpc-Server")
         if addr == "" {
-            w.WriteHeader(http.StatusInternalServerError)
+            w.WriteHeader(http.StatusBadRequest)
             return
         }
-        r.putServer(addr)
+        r.removeServer(addr)
+        if req.Header.Get("X-Geerpc-Replicated") == "" {
+            r.replicate("DELETE", &ServerItem{Addr: addr})
+        }
     default:
         w.WriteHeader(http.StatusMethodNotAllowed)
     }
 }
 
 
+// 元数据通过 X-Geerpc-Services, X-Geerpc-Version 和 X-Geerpc-Weight 承载
+func parseServerItem(header http.Header) (*ServerItem, error) {
+    item := &ServerItem {
+        Addr: header.Get("X-Geerpc-Server"),
+        Version: header.Get("X-Geerpc-Version"),
+    }
+    if item.Addr == "" {
+        return nil, errors.New("rpc registry: missing server address")
+    }
+
+    for _, name := range strings.Split(header.Get("X-Geerpc-Services"), ",") {
+        if strings.TrimSpace(name) != "" {
+            item.Services = append(item.Services, strings.TrimSpace(name))
+        }
+    }
+
+    if weight := header.Get("X-Geerpc-Weight"); weight != "" {
+        w, err := strconv.Atoi(weight)
+        if err != nil || w < 0 {
+            return nil, errors.New("rpc registry: invalid weight " + weight)
+        }
+        item.Weight = w
+    }
+    return item, nil
+}
+
+
+func setServerItem(header http.Header, item *ServerItem) {
+    header.Set("X-Geerpc-Server", item.Addr)
+    if len(item.Services) > 0 {
+        header.Set("X-Geerpc-Services", strings.Join(item.Services, ","))
+    }
+    if item.Version != "" {
+        header.Set("X-Geerpc-Version", item.Version)
+    }
+    if item.Weight != 0 {
+        header.Set("X-Geerpc-Weight", strconv.Itoa(item.Weight))
+    }
+}
+
+
 func (r *GeeRegistry) HandleHTTP(registryPath string) {
     http.Handle(registryPath, r)
     log.Println("rpc registry path:", registryPath)
@@ -103,29 +256,108 @@ func HandleHTTP() {
 }
 
 
-func Heartbeat(registry string, addr string, duration time.Duration) {
+// 定期向注册中心发送心跳，返回的 stop 用于停止发送
+func Heartbeat(registry string, addr string, duration time.Duration) (stop func()) {
+    return HeartbeatServer(registry, &ServerItem{Addr: addr}, duration)
+}
+
+
+// 和 Heartbeat 相同，同时向注册中心上报实例的服务名、版本和权重
+func HeartbeatServer(registry string, item *ServerItem, duration time.Duration) (stop func()) {
+    return heartbeat(registry, item, duration, minHeartbeatBackoff)
+}
+
+
+// minBackoff 为发送失败后第一次重试的间隔
+func heartbeat(registry string, item *ServerItem, duration, minBackoff time.Duration) (stop func()) {
     if duration == 0 {
         // 默认周期比注册中心设置的过期时间少 1 min
         duration = defaultTimeout - time.Duration(1) * time.Minute
     }
-    err := sendHeartbeat(registry, addr)
+    done := make(chan struct{})
+    var once sync.Once
+    err := sendHeartbeat(registry, item)
     go func() {
-        t := time.NewTicker(duration)
-        for err == nil {
-            <-t.C
-            err = sendHeartbeat(registry, addr)
+        var backoff time.Duration
+        for {
+            next := duration
+            if err != nil {
+                // 发送失败后按指数退避重试，最长不超过心跳周期
+                backoff = nextBackoff(backoff, minBackoff, duration)
+                next = backoff
+            } else {
+                backoff = 0
+            }
+
+            t := time.NewTimer(next)
+            select {
+            case <-t.C:
+            case <-done:
+                t.Stop()
+                return
+            }
+            err = sendHeartbeat(registry, item)
         }
     } ()
+
+    return func() {
+        once.Do(func() {
+            close(done)
+        })
+    }
 }
 
 
-func sendHeartbeat(registry string, addr string) error {
-    log.Println(addr, "send heart beat to registry", registry)
-    httpClient := &http.Client{}
-    req, _ := http.NewRequest("POST", registry, nil)
+// 从注册中心注销实例，注销前应先停止心跳
+func Deregister(registry string, addr string) error {
+    req, _ := http.NewRequest("DELETE", registry, nil)
     req.Header.Set("X-Geerpc-Server", addr)
-    if _, err := httpClient.Do(req); err != nil {
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        log.Println("rpc server: deregister error:", err)
+        return err
+    }
+    _ = resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return errors.New("rpc server: deregister error: " + resp.Status)
+    }
+    return nil
+}
+
+
+const minHeartbeatBackoff = time.Second
+
+
+func nextBackoff(backoff, min, max time.Duration) time.Duration {
+    if backoff == 0 {
+        backoff = min
+    } else {
+        backoff *= 2
+    }
+    if backoff > max {
+        backoff = max
+    }
+    return backoff
+}
+
+
+func sendHeartbeat(registry string, item *ServerItem) error {
+    log.Println(item.Addr, "send heart beat to registry", registry)
+    httpClient := &http.Client{Timeout: time.Second * 10}
+    req, _ := http.NewRequest("POST", registry, nil)
+    setServerItem(req.Header, item)
+    resp, err := httpClient.Do(req)
+    if err != nil {
         log.Println("rpc server: heart beat error:", err)
+        return err
+    }
+    _ = resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        err = errors.New("rpc server: heart beat error: " + resp.Status)
+        log.Println(err)
+        return err
     }
     return nil
 }
@@ -0,0 +1,219 @@
+package registry
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+)
+
+
+func TestServerMetadata(test *testing.T) {
+    r := NewGeeRegistry(defaultTimeout)
+    ts := httptest.NewServer(r)
+    defer ts.Close()
+
+    items := []*ServerItem {
+        {Addr: "tcp@127.0.0.1:1001", Services: []string{"Foo", "Bar"}, Version: "v1", Weight: 3},
+        {Addr: "tcp@127.0.0.1:1002", Services: []string{"Foo"}, Version: "v2"},
+        {Addr: "tcp@127.0.0.1:1003"},
+    }
+    for _, item := range items {
+        if err := sendHeartbeat(ts.URL, item); err != nil {
+            test.Fatal("heartbeat error:", err)
+        }
+    }
+
+    resp, err := http.Get(ts.URL + "?service=Bar")
+    if err != nil {
+        test.Fatal("get error:", err)
+    }
+    defer resp.Body.Close()
+
+    var alive []*ServerItem
+    if err := json.NewDecoder(resp.Body).Decode(&alive); err != nil {
+        test.Fatal("decode error:", err)
+    }
+    // 未声明服务的实例视为提供所有服务
+    if len(alive) != 2 || alive[0].Addr != items[0].Addr || alive[1].Addr != items[2].Addr {
+        test.Fatalf("unexpected servers %+v", alive)
+    }
+    if alive[0].Version != "v1" || alive[0].Weight != 3 || len(alive[0].Services) != 2 {
+        test.Fatalf("metadata lost: %+v", alive[0])
+    }
+    if resp.Header.Get("X-Geerpc-Servers") != items[0].Addr + "," + items[2].Addr {
+        test.Fatal("unexpected X-Geerpc-Servers:", resp.Header.Get("X-Geerpc-Servers"))
+    }
+
+    req, _ := http.NewRequest("POST", ts.URL, nil)
+    req.Header.Set("X-Geerpc-Server", "tcp@127.0.0.1:1004")
+    req.Header.Set("X-Geerpc-Weight", "heavy")
+    resp, err = http.DefaultClient.Do(req)
+    if err != nil || resp.StatusCode != http.StatusBadRequest {
+        test.Fatal("invalid weight should be rejected")
+    }
+}
+
+
+func TestDeregister(test *testing.T) {
+    r := NewGeeRegistry(defaultTimeout)
+    ts := httptest.NewServer(r)
+    defer ts.Close()
+
+    stop := Heartbeat(ts.URL, "tcp@127.0.0.1:1001", time.Millisecond * 20)
+    Heartbeat(ts.URL, "tcp@127.0.0.1:1002", 0)
+    if len(r.aliveServers("")) != 2 {
+        test.Fatal("expect 2 alive servers")
+    }
+
+    stop()
+    if err := Deregister(ts.URL, "tcp@127.0.0.1:1001"); err != nil {
+        test.Fatal("deregister error:", err)
+    }
+    // 心跳已停止，实例不会被重新注册
+    time.Sleep(time.Millisecond * 60)
+    alive := r.aliveServers("")
+    if len(alive) != 1 || alive[0].Addr != "tcp@127.0.0.1:1002" {
+        test.Fatalf("unexpected servers %+v", alive)
+    }
+
+    req, _ := http.NewRequest("DELETE", ts.URL, nil)
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil || resp.StatusCode != http.StatusBadRequest {
+        test.Fatal("deregister without address should be rejected")
+    }
+}
+
+
+func TestWatch(test *testing.T) {
+    r := NewGeeRegistry(defaultTimeout)
+    ts := httptest.NewServer(r)
+    defer ts.Close()
+
+    watch := func(index uint64) *WatchResult {
+        resp, err := http.Get(ts.URL + "?watch=1&index=" + strconv.FormatUint(index, 10))
+        if err != nil {
+            test.Fatal("watch error:", err)
+        }
+        defer resp.Body.Close()
+        var result WatchResult
+        if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+            test.Fatal("decode error:", err)
+        }
+        return &result
+    }
+
+    // index=0 立即返回当前列表
+    result := watch(0)
+    if len(result.Servers) != 0 || result.Index == 0 {
+        test.Fatalf("unexpected watch result %+v", result)
+    }
+
+    // 版本号未变化时阻塞，直到有实例注册
+    time.AfterFunc(time.Millisecond * 50, func() {
+        r.putServer(&ServerItem{Addr: "tcp@127.0.0.1:1001"})
+    })
+    start := time.Now()
+    next := watch(result.Index)
+    if time.Since(start) < time.Millisecond * 40 || time.Since(start) > time.Second {
+        test.Fatal("watch should return right after the change, took", time.Since(start))
+    }
+    if next.Index == result.Index || len(next.Servers) != 1 || next.Servers[0].Addr != "tcp@127.0.0.1:1001" {
+        test.Fatalf("unexpected watch result %+v", next)
+    }
+
+    // 心跳不改变版本号
+    r.putServer(&ServerItem{Addr: "tcp@127.0.0.1:1001"})
+    time.AfterFunc(time.Millisecond * 50, func() {
+        r.removeServer("tcp@127.0.0.1:1001")
+    })
+    result = watch(next.Index)
+    if result.Index == next.Index || len(result.Servers) != 0 {
+        test.Fatalf("unexpected watch result %+v", result)
+    }
+}
+
+
+func TestPersistence(test *testing.T) {
+    dir := test.TempDir()
+    r := NewGeeRegistry(defaultTimeout)
+    if err := r.EnablePersistence(dir); err != nil {
+        test.Fatal("enable persistence error:", err)
+    }
+    r.putServer(&ServerItem{Addr: "tcp@127.0.0.1:1001", Services: []string{"Foo"}, Weight: 2})
+    r.putServer(&ServerItem{Addr: "tcp@127.0.0.1:1002"})
+    r.putServer(&ServerItem{Addr: "tcp@127.0.0.1:1003"})
+    r.removeServer("tcp@127.0.0.1:1002")
+    _ = r.Close()
+
+    // 重启后从快照和 WAL 恢复
+    r = NewGeeRegistry(defaultTimeout)
+    if err := r.EnablePersistence(dir); err != nil {
+        test.Fatal("enable persistence error:", err)
+    }
+    alive := r.aliveServers("")
+    if len(alive) != 2 || alive[0].Addr != "tcp@127.0.0.1:1001" || alive[1].Addr != "tcp@127.0.0.1:1003" {
+        test.Fatalf("unexpected servers %+v", alive)
+    }
+    if alive[0].Weight != 2 || len(alive[0].Services) != 1 {
+        test.Fatalf("metadata lost: %+v", alive[0])
+    }
+
+    // 超过 maxWALRecords 后生成快照
+    for i := 0; i <= maxWALRecords; i++ {
+        r.putServer(&ServerItem{Addr: "tcp@127.0.0.1:1003", Weight: i})
+    }
+    if r.store.records >= maxWALRecords {
+        test.Fatal("wal should be compacted, got", r.store.records, "records")
+    }
+    _ = r.Close()
+
+    r = NewGeeRegistry(defaultTimeout)
+    if err := r.EnablePersistence(dir); err != nil {
+        test.Fatal("enable persistence error:", err)
+    }
+    defer r.Close()
+    alive = r.aliveServers("")
+    if len(alive) != 2 || alive[1].Weight != maxWALRecords {
+        test.Fatalf("unexpected servers %+v", alive)
+    }
+}
+
+
+func TestReplication(test *testing.T) {
+    r1, r2 := NewGeeRegistry(defaultTimeout), NewGeeRegistry(defaultTimeout)
+    ts1, ts2 := httptest.NewServer(r1), httptest.NewServer(r2)
+    defer ts1.Close()
+    defer ts2.Close()
+
+    stop := HeartbeatServer(ts1.URL, &ServerItem{Addr: "tcp@127.0.0.1:1001", Version: "v1"}, time.Minute)
+    defer stop()
+
+    // 新加入的注册中心先从 peer 拉取已有的实例
+    r1.AddPeers(ts2.URL)
+    r2.AddPeers(ts1.URL)
+    defer r1.Close()
+    defer r2.Close()
+    if alive := r2.aliveServers(""); len(alive) != 1 || alive[0].Version != "v1" {
+        test.Fatalf("unexpected servers %+v", alive)
+    }
+
+    waitServers := func(r *GeeRegistry, n int) {
+        for i := 0; i < 50; i++ {
+            if len(r.aliveServers("")) == n {
+                return
+            }
+            time.Sleep(time.Millisecond * 10)
+        }
+        test.Fatalf("expect %d servers, got %+v", n, r.aliveServers(""))
+    }
+    HeartbeatServer(ts2.URL, &ServerItem{Addr: "tcp@127.0.0.1:1002"}, time.Minute)
+    waitServers(r1, 2)
+    if err := Deregister(ts1.URL, "tcp@127.0.0.1:1001"); err != nil {
+        test.Fatal("deregister error:", err)
+    }
+    waitServers(r2, 1)
+    waitServers(r1, 1)
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "time"
+)
+
+/*
+多个注册中心互为 peer，收到实例的注册、心跳和注销后异步转发给所有 peer。
+转发的请求带有 X-Geerpc-Replicated 标记，peer 收到后不会再次转发，避免循环。
+实例的过期和健康检查由每个注册中心各自判断，不做同步。
+*/
+
+
+const replicateQueueSize = 1024
+
+
+type replication struct {
+    method string       // POST 或 DELETE
+    item *ServerItem
+}
+
+
+type peer struct {
+    addr string
+    queue chan *replication
+    done chan struct{}
+}
+
+
+// 添加需要同步的其他注册中心，并从第一个可用的 peer 拉取当前的实例列表
+func (r *GeeRegistry) AddPeers(peers ...string) {
+    for _, addr := range peers {
+        p := &peer {
+            addr: addr,
+            queue: make(chan *replication, replicateQueueSize),
+            done: make(chan struct{}),
+        }
+        go p.run()
+
+        r.mtx.Lock()
+        r.peers = append(r.peers, p)
+        r.mtx.Unlock()
+    }
+
+    for _, addr := range peers {
+        if err := r.syncFrom(addr); err != nil {
+            log.Println("rpc registry: sync from peer error:", err)
+            continue
+        }
+        break
+    }
+}
+
+
+// 停止同步并关闭持久化文件
+func (r *GeeRegistry) Close() error {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+
+    for _, p := range r.peers {
+        close(p.done)
+    }
+    r.peers = nil
+    if r.store != nil {
+        err := r.store.close()
+        r.store = nil
+        return err
+    }
+    return nil
+}
+
+
+func (r *GeeRegistry) syncFrom(addr string) error {
+    httpClient := &http.Client{Timeout: time.Second * 10}
+    resp, err := httpClient.Get(addr)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    var items []*ServerItem
+    if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+        return err
+    }
+    for _, item := range items {
+        r.putServer(item)
+    }
+    return nil
+}
+
+
+// 把注册中心收到的请求转发给所有 peer，队列满时丢弃，之后的心跳会补上
+func (r *GeeRegistry) replicate(method string, item *ServerItem) {
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+
+    for _, p := range r.peers {
+        select {
+        case p.queue <- &replication{method: method, item: item}:
+        default:
+            log.Println("rpc registry: replicate queue is full, drop", method, item.Addr, "to", p.addr)
+        }
+    }
+}
+
+
+func (p *peer) run() {
+    httpClient := &http.Client{Timeout: time.Second * 10}
+    for {
+        select {
+        case rep := <-p.queue:
+            req, _ := http.NewRequest(rep.method, p.addr, nil)
+            setServerItem(req.Header, rep.item)
+            req.Header.Set("X-Geerpc-Replicated", "1")
+            resp, err := httpClient.Do(req)
+            if err != nil {
+                log.Println("rpc registry: replicate to peer error:", err)
+                continue
+            }
+            _ = resp.Body.Close()
+        case <-p.done:
+            return
+        }
+    }
+}
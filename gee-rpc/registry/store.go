@@ -0,0 +1,184 @@
+package registry
+
+import (
+    "bufio"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+/*
+持久化分为快照和 WAL 两个文件:
+registry.snapshot   某一时刻的完整实例列表，json 数组
+registry.wal        快照之后实例列表的每次变化，每行一条 json 记录
+
+启动时先读取快照再重放 WAL，WAL 记录数超过 maxWALRecords 时重新生成快照并清空 WAL。
+心跳只更新时间，不写入 WAL，恢复出的实例从恢复时刻开始重新计算过期时间。
+*/
+
+
+const (
+    walPut = "put"
+    walDelete = "delete"
+
+    snapshotFile = "registry.snapshot"
+    walFile = "registry.wal"
+    maxWALRecords = 1000
+)
+
+
+type walRecord struct {
+    Op string
+    Server *ServerItem
+}
+
+
+type store struct {
+    dir string
+    wal *os.File
+    records int         // WAL 中的记录数
+}
+
+
+// 开启持久化，从 dir 中恢复之前的实例列表，之后的每次变化都会写入 dir
+func (r *GeeRegistry) EnablePersistence(dir string) error {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return err
+    }
+    s := &store{dir: dir}
+    servers, err := s.load()
+    if err != nil {
+        return err
+    }
+
+    r.mtx.Lock()
+    defer r.mtx.Unlock()
+    for addr, item := range servers {
+        if _, ok := r.servers[addr]; !ok {
+            item.start = time.Now()
+            r.servers[addr] = item
+        }
+    }
+    if err := s.compact(r.servers); err != nil {
+        return err
+    }
+    r.store = s
+    if len(servers) > 0 {
+        r.wake()
+    }
+    return nil
+}
+
+
+func (s *store) load() (map[string]*ServerItem, error) {
+    servers := make(map[string]*ServerItem)
+
+    data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    if len(data) > 0 {
+        var items []*ServerItem
+        if err := json.Unmarshal(data, &items); err != nil {
+            return nil, err
+        }
+        for _, item := range items {
+            servers[item.Addr] = item
+        }
+    }
+
+    f, err := os.Open(filepath.Join(s.dir, walFile))
+    if os.IsNotExist(err) {
+        return servers, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        var record walRecord
+        // 写入时崩溃可能留下不完整的最后一行，忽略之后的内容
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Server == nil {
+            break
+        }
+        switch record.Op {
+        case walPut:
+            servers[record.Server.Addr] = record.Server
+        case walDelete:
+            delete(servers, record.Server.Addr)
+        }
+    }
+    return servers, scanner.Err()
+}
+
+
+func (s *store) append(op string, item *ServerItem, servers map[string]*ServerItem) error {
+    data, err := json.Marshal(&walRecord{Op: op, Server: item})
+    if err != nil {
+        return err
+    }
+    if _, err := s.wal.Write(append(data, '\n')); err != nil {
+        return err
+    }
+    if s.records++; s.records >= maxWALRecords {
+        return s.compact(servers)
+    }
+    return s.wal.Sync()
+}
+
+
+// 把当前的实例列表写入快照并清空 WAL
+func (s *store) compact(servers map[string]*ServerItem) error {
+    items := make([]*ServerItem, 0, len(servers))
+    for _, item := range servers {
+        items = append(items, item)
+    }
+    data, err := json.Marshal(items)
+    if err != nil {
+        return err
+    }
+
+    // 先写临时文件再重命名，保证快照文件总是完整的
+    tmp := filepath.Join(s.dir, snapshotFile + ".tmp")
+    if err := writeFileSync(tmp, data); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+        return err
+    }
+
+    if s.wal != nil {
+        _ = s.wal.Close()
+    }
+    s.wal, err = os.Create(filepath.Join(s.dir, walFile))
+    s.records = 0
+    return err
+}
+
+
+func (s *store) close() error {
+    if s.wal == nil {
+        return nil
+    }
+    return s.wal.Close()
+}
+
+
+func writeFileSync(name string, data []byte) error {
+    f, err := os.Create(name)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        _ = f.Close()
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        _ = f.Close()
+        return err
+    }
+    return f.Close()
+}
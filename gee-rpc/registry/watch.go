@@ -0,0 +1,63 @@
+package registry
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+
+// watch 请求的返回结果
+type WatchResult struct {
+    Index uint64
+    Epoch string            // 注册中心本次启动的标识，和客户端上次的不同时版本号不可比较
+    Servers []*ServerItem
+}
+
+
+const (
+    defaultWatchTimeout = time.Second * 30     // 长轮询的最长等待时间
+    watchExpireInterval = time.Second          // 等待期间检查实例是否过期的周期
+)
+
+
+// 长轮询: GET ?watch=1&index=N[&epoch=E]，版本号与 N 相同时阻塞，直到实例列表变化或等待超时
+// 返回当前的版本号和实例列表，客户端使用返回的版本号和 epoch 发起下一次 watch
+// epoch 和注册中心当前的不同 (注册中心已重启) 时立即返回，避免版本号碰巧相同时阻塞
+func (r *GeeRegistry) watch(w http.ResponseWriter, req *http.Request) {
+    query := req.URL.Query()
+    index, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+    service := query.Get("service")
+    epoch := query.Get("epoch")
+
+    timeout := time.NewTimer(defaultWatchTimeout)
+    defer timeout.Stop()
+    expire := time.NewTicker(watchExpireInterval)
+    defer expire.Stop()
+
+    var current uint64
+    var alive []*ServerItem
+    var notify chan struct{}
+    for {
+        // 注册中心重启后版本号会变小，只要不相等就立即返回
+        current, alive, notify = r.snapshot(service)
+        if current != index || (epoch != "" && epoch != r.epoch) {
+            break
+        }
+
+        select {
+        case <-notify:
+            continue
+        case <-expire.C:
+            continue
+        case <-req.Context().Done():
+            return
+        case <-timeout.C:
+        }
+        break
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(&WatchResult{Index: current, Epoch: r.epoch, Servers: alive})
+}
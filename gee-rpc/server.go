@@ -1,6 +1,9 @@
 package geerpc
 
 import (
+    "bytes"
+    "context"
+    "crypto/tls"
     "encoding/json"
     "geerpc/codec"
     "io"
@@ -8,6 +11,7 @@ import (
     "net"
     "net/http"
     "reflect"
+    "sort"
     "sync"
     "errors"
     "strings"
@@ -26,6 +30,13 @@ type Option struct {
     // 超时设定, 0 表示不设限
     ConnectTimeout time.Duration
     HandleTimeout time.Duration
+    TLSConfig *tls.Config `json:"-"`      // 客户端使用，不为 nil 时通过 TLS 连接，不参与协商
+    Credentials Credentials `json:"-"`    // 客户端使用，建立连接时生成 Auth
+    Auth map[string]string `json:",omitempty"`    // 认证信息，由服务端的 Authenticator 校验
+    Version int         // 协议版本，客户端为 0 时使用 ProtocolVersion，为负数时按旧版本协议连接
+    AckTimeout time.Duration `json:"-"`   // 客户端等待服务端回复的时间，超时认为服务端是旧版本，为 0 时使用 DefaultOption.AckTimeout
+    Compression string `json:",omitempty"`    // 客户端请求的压缩算法，服务端支持时双方按帧压缩，见 codec.NewCompressCodec
+    CompressThreshold int `json:",omitempty"`   // 超过该长度的消息才压缩，为 0 时使用 codec.DefaultCompressThreshold
 }
 
 
@@ -33,12 +44,21 @@ var DefaultOption = &Option {
     MagicNumber: MagicNumber,
     CodecType: codec.GobType,
     ConnectTimeout: time.Second * 10,
+    AckTimeout: time.Millisecond * 500,
 }
 
 
 // RPC Server
 type Server struct {
     serviceMap sync.Map
+    interceptors []ServerInterceptor
+    authenticator Authenticator
+
+    mtx sync.Mutex
+    listeners map[net.Listener]struct{}
+    conns map[codec.Codec]*sync.WaitGroup     // 每个连接上正在处理的请求
+    inShutdown bool
+    onShutdown []func()
 }
 
 
@@ -51,10 +71,17 @@ var DefaultServer = NewServer()
 
 
 func (server *Server) Accept(listener net.Listener) {
+    if !server.trackListener(listener, true) {
+        return
+    }
+    defer server.trackListener(listener, false)
+
     for {
         conn, err := listener.Accept()
         if err != nil {
-            log.Println("rpc server: accept error:", err)
+            if !server.shuttingDown() {
+                log.Println("rpc server: accept error:", err)
+            }
             return
         }
         go server.ServeConn(conn)
@@ -72,8 +99,15 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
         _ = conn.Close()
     } ()
 
+    ctx, err := serverTLS(context.Background(), conn)
+    if err != nil {
+        log.Println("rpc server: tls handshake error:", err)
+        return
+    }
+
     var opt Option
-    err := json.NewDecoder(conn).Decode(&opt)
+    dec := json.NewDecoder(conn)
+    err = dec.Decode(&opt)
     if err != nil {
         log.Println("rpc server: options error:", err)
         return
@@ -84,47 +118,176 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser) {
         return
     }
 
+    // 协商和认证的结果回复给客户端，失败时客户端可以拿到具体的错误
     newCodecFunc := codec.NewCodecFuncMap[opt.CodecType]
     if newCodecFunc == nil {
-        log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+        err = Errorf(InvalidArgument, "rpc server: invalid codec type %s", opt.CodecType)
+    } else {
+        ctx, err = server.authenticate(ctx, &opt)
+    }
+    // 旧版本的客户端不读取回复，出错时只能直接关闭连接
+    var compressor codec.Compressor
+    if opt.Version > 0 {
+        reply := &handshakeReply{ServerInfo: server.serverInfo(opt.Version)}
+        if compressor = codec.GetCompressor(opt.Compression); compressor != nil {
+            reply.Compression = opt.Compression
+        }
+        if err != nil {
+            reply.Error, reply.ErrorCode = err.Error(), int(CodeOf(err))
+        }
+        if e := json.NewEncoder(conn).Encode(reply); e != nil {
+            log.Println("rpc server: handshake error:", e)
+            return
+        }
+    }
+    if err != nil {
+        log.Println("rpc server: handshake rejected:", err)
+        return
+    }
+
+    // json.Decoder 可能多读了 Option 之后的数据，需要去掉 Encoder 附加的换行后拼接回去再交给 codec
+    buffered, _ := io.ReadAll(dec.Buffered())
+    buffered = bytes.TrimLeft(buffered, " \t\r\n")
+    conn = &bufferedConn{ReadWriteCloser: conn, r: io.MultiReader(bytes.NewReader(buffered), conn)}
+    if compressor != nil {
+        server.serveCodec(ctx, codec.NewCompressCodec(conn, newCodecFunc, compressor, opt.CompressThreshold), &opt)
         return
     }
+    server.serveCodec(ctx, newCodecFunc(conn), &opt)
+}
+
+
+type bufferedConn struct {
+    io.ReadWriteCloser
+    r io.Reader
+}
+
 
-    server.serveCodec(newCodecFunc(conn), &opt)
+func (c *bufferedConn) Read(p []byte) (int, error) {
+    return c.r.Read(p)
 }
 
 
 var invalidRequest = struct{}{}
 
 
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
+// ctx 携带连接级别的信息，如 TLS 状态，连接上所有请求的 ctx 都由它派生
+func (server *Server) serveCodec(parent context.Context, cc codec.Codec, opt *Option) {
     sending := new(sync.Mutex)
     wg := new(sync.WaitGroup)
+    if !server.trackConn(cc, wg, true) {
+        _ = cc.Close()
+        return
+    }
+    defer server.trackConn(cc, wg, false)
+
+    ctx, cancel := context.WithCancel(parent)
+    calls := &inflight {
+        cancels: make(map[uint64]context.CancelFunc),
+        streams: make(map[uint64]*ServerStream),
+    }
     for {
         req, err := server.readRequest(cc)
         if err != nil {
             if req == nil {
                 break
             }
-            req.header.Error = err.Error()
+            setHeaderError(req.header, err)
+            req.header.EOS = req.header.Stream     // 建立流失败时直接结束流
             server.sendResponse(cc, req.header, invalidRequest, sending)
             continue
         }
 
-        wg.Add(1)
+        if req.header.Cancel {
+            calls.cancel(req.header.Seq)
+            continue
+        }
+
+        if req.header.Stream && req.header.ServiceMethod == "" {
+            // 已建立的流上的消息，交给对应的流读取
+            if err := calls.deliver(cc, req.header); err != nil {
+                log.Println("rpc server: read stream body error:", err)
+            }
+            continue
+        }
+
+        if !server.addRequest(wg) {
+            setHeaderError(req.header, ErrServerShutdown)
+            req.header.EOS = req.header.Stream
+            server.sendResponse(cc, req.header, invalidRequest, sending)
+            continue
+        }
+        req.ctx, req.cancel = calls.add(ctx, req.header)
+        if req.mType.kind != unaryCall {
+            // 流需要在读取下一条消息之前登记
+            req.stream = &ServerStream{stream: newStream(req.header.Seq, opt.CodecType, cc.ReadBody, func(header *codec.Header, body interface{}) error {
+                return server.sendResponse(cc, header, body, sending)
+            })}
+            calls.addStream(req.header.Seq, req.stream)
+            go server.handleStream(cc, req, sending, wg, calls)
+            continue
+        }
         go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
     }
+    cancel()    // 连接已断开，通知所有正在处理的请求
     wg.Wait()
     _ = cc.Close()
 }
 
 
+// 记录连接上正在处理的请求，用于响应客户端发来的取消消息，以及分发流上的消息
+type inflight struct {
+    mtx sync.Mutex
+    cancels map[uint64]context.CancelFunc
+    streams map[uint64]*ServerStream
+}
+
+
+// 根据 header 中的超时时间和元数据创建请求的 context，截止时间按服务端的时钟计算，返回的 cancel 会同时移除记录
+func (f *inflight) add(parent context.Context, header *codec.Header) (context.Context, context.CancelFunc) {
+    var ctx context.Context
+    var cancel context.CancelFunc
+    parent = withIncomingMetadata(parent, header.Metadata)
+    if header.Timeout > 0 {
+        ctx, cancel = context.WithTimeout(parent, time.Duration(header.Timeout))
+    } else {
+        ctx, cancel = context.WithCancel(parent)
+    }
+
+    seq := header.Seq
+    f.mtx.Lock()
+    f.cancels[seq] = cancel
+    f.mtx.Unlock()
+
+    return ctx, func() {
+        f.mtx.Lock()
+        delete(f.cancels, seq)
+        f.mtx.Unlock()
+        cancel()
+    }
+}
+
+
+func (f *inflight) cancel(seq uint64) {
+    f.mtx.Lock()
+    cancel := f.cancels[seq]
+    f.mtx.Unlock()
+
+    if cancel != nil {
+        cancel()
+    }
+}
+
+
 type request struct {
     header *codec.Header
     argv reflect.Value
     replyv reflect.Value
     svc *service
     mType *methodType
+    ctx context.Context
+    cancel context.CancelFunc
+    stream *ServerStream
 }
 
 
@@ -148,12 +311,38 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
     }
 
     req := &request{header: header}
+    if header.Cancel {
+        // 取消消息不携带参数
+        _ = cc.ReadBody(nil)
+        return req, nil
+    }
+    if header.Stream && header.ServiceMethod == "" {
+        // 已建立的流上的消息，body 由流自己读取
+        return req, nil
+    }
+
     req.svc, req.mType, err = server.findService(header.ServiceMethod)
+    if err == nil && header.Stream != (req.mType.kind != unaryCall) {
+        err = NewError(InvalidArgument, "rpc server: stream mismatch for " + header.ServiceMethod)
+    }
     if err != nil {
+        _ = cc.ReadBody(nil)
         return req, err
     }
+
+    // 客户端流和双向流建立时不携带参数
+    if req.mType.kind == clientStreaming || req.mType.kind == bidiStreaming {
+        if req.mType.kind == clientStreaming {
+            req.replyv = req.mType.newReplyv()
+        }
+        _ = cc.ReadBody(nil)
+        return req, nil
+    }
+
     req.argv = req.mType.newArgv()
-    req.replyv = req.mType.newReplyv()
+    if req.mType.kind == unaryCall {
+        req.replyv = req.mType.newReplyv()
+    }
 
     argv := req.argv.Interface()
     if req.argv.Type().Kind() != reflect.Ptr {
@@ -169,52 +358,103 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 }
 
 
-func (server *Server) sendResponse(cc codec.Codec, header *codec.Header, body interface{}, sending *sync.Mutex) {
+func (server *Server) sendResponse(cc codec.Codec, header *codec.Header, body interface{}, sending *sync.Mutex) error {
     sending.Lock()
     defer sending.Unlock()
     err := cc.Write(header, body)
     if err != nil {
         log.Println("rpc server: write response error:", err)
     }
+    return err
 }
 
 
 func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
     defer wg.Done()
-    called := make(chan struct{})
-    sent := make(chan struct{})
+    defer req.cancel()
+
+    // 方法注册时设定的超时和连接的超时同时存在时，取较小的一个
+    if t := req.mType.timeout; t > 0 && (timeout == 0 || t < timeout) {
+        timeout = t
+    }
+    ctx := req.ctx
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+
+    // 带缓冲，超时后处理函数返回时不会阻塞
+    called := make(chan error, 1)
+    // 拦截器拿到的是 header 的副本，超时回复时不会产生竞争
+    header := *req.header
     go func() {
-        err := req.svc.call(req.mType, req.argv, req.replyv)
-        called <- struct{}{}
+        called <- server.invoke(ctx, &header, req)
+    } ()
 
-        if err != nil {
-            req.header.Error = err.Error()
-            server.sendResponse(cc, req.header, invalidRequest, sending)
-            sent <- struct{}{}
-            return
+    // 只有这里会发送响应，保证每个请求恰好回复一次
+    select {
+    case err := <-called:
+        server.sendResult(cc, req, err, sending)
+    case <-ctx.Done():
+        // 超时或被客户端取消，立即回复并释放请求，处理函数之后的结果会被丢弃
+        err := ctx.Err()
+        if req.ctx.Err() == nil {
+            err = Errorf(DeadlineExceeded, "rpc server: request handle timeout: expect within %s", timeout)
         }
+        server.sendResult(cc, req, err, sending)
+    }
+}
 
-        server.sendResponse(cc, req.header, req.replyv.Interface(), sending)
-        sent <- struct{}{}
+
+// 依次执行拦截器，最后调用服务方法
+// 服务方法中的 panic 由 service.call 处理，拦截器中的 panic 在这里转换为错误，同样不影响其他请求
+func (server *Server) invoke(ctx context.Context, header *codec.Header, req *request) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            msg := fmt.Sprintf("rpc server: panic in interceptor of %s: %v", header.ServiceMethod, r)
+            log.Printf("%s\n\n", trace(msg))
+            err = NewError(Internal, msg)
+        }
     } ()
 
-    if timeout == 0 {
-        <-called
-        <-sent
-        return
+    handler := func(ctx context.Context, _ *codec.Header, _, _ interface{}) error {
+        return req.svc.call(ctx, req.mType, req.argv, req.replyv)
     }
-    select {
-    case <-time.After(timeout):
-        req.header.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
+    return chainHandler(server.interceptors, handler)(ctx, header, req.argv.Interface(), req.replyv.Interface())
+}
+
+
+func (server *Server) sendResult(cc codec.Codec, req *request, err error, sending *sync.Mutex) {
+    req.header.Metadata = nil      // 响应不回传请求的元数据
+    if err != nil {
+        setHeaderError(req.header, err)
         server.sendResponse(cc, req.header, invalidRequest, sending)
-    case <-called:
-        <-sent
+        return
     }
+    server.sendResponse(cc, req.header, req.replyv.Interface(), sending)
+}
+
+
+// 注册服务时的可选配置
+type ServiceOption struct {
+    HandleTimeout time.Duration     // 服务中所有方法的处理超时，0 表示不设限
+    MethodTimeout map[string]time.Duration      // 单个方法的处理超时，覆盖 HandleTimeout
 }
 
 
-func (server *Server) Register(rcvr interface{}) error {
+func (server *Server) Register(rcvr interface{}, opts ...*ServiceOption) error {
+    if len(opts) > 1 {
+        return errors.New("rpc: number of service options is more than 1")
+    }
+
     s := newService(rcvr)
+    if len(opts) == 1 && opts[0] != nil {
+        if err := s.setTimeout(opts[0]); err != nil {
+            return err
+        }
+    }
+
     // LoadOrStore 如果 map 中存在给定的 key，则返回现存的 value，否则存储给定的 value
     if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
         return errors.New("rpc: service already defined:" + s.name)
@@ -223,29 +463,41 @@ func (server *Server) Register(rcvr interface{}) error {
 }
 
 
-func Register(rcvr interface{}) error {
-    return DefaultServer.Register(rcvr)
+func Register(rcvr interface{}, opts ...*ServiceOption) error {
+    return DefaultServer.Register(rcvr, opts...)
+}
+
+
+// 返回所有已注册的服务名，可以在注册中心上报
+func (server *Server) Services() []string {
+    var names []string
+    server.serviceMap.Range(func(name, _ interface{}) bool {
+        names = append(names, name.(string))
+        return true
+    })
+    sort.Strings(names)
+    return names
 }
 
 
 func (server *Server) findService(serviceMethod string) (svc *service, mType *methodType, err error) {
     dotIdx := strings.LastIndex(serviceMethod, ".")     // Service.Method
     if dotIdx < 0 {
-        err = errors.New("rpc server: service/method request ill-formed:" + serviceMethod)
+        err = NewError(InvalidArgument, "rpc server: service/method request ill-formed:" + serviceMethod)
         return
     }
 
     serviceName, methodName := serviceMethod[:dotIdx], serviceMethod[dotIdx+1:]
     s, ok := server.serviceMap.Load(serviceName)
     if !ok {
-        err = errors.New("rpc server: can't find service " + serviceName)
+        err = NewError(NotFound, "rpc server: can't find service " + serviceName)
         return
     }
 
     svc = s.(*service)
     mType = svc.method[methodName]
     if mType == nil {
-        err = errors.New("rpc server: can't find method " + methodName)
+        err = NewError(NotFound, "rpc server: can't find method " + methodName)
         return
     }
 
@@ -0,0 +1,373 @@
+package geerpc
+
+import (
+    "context"
+    "errors"
+    "geerpc/codec"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+
+type Foo int
+
+type Args struct {
+    Num1 int
+    Num2 int
+}
+
+
+func (foo Foo) Sum(args Args, reply *int) error {
+    *reply = args.Num1 + args.Num2
+    return nil
+}
+
+
+var sleepCanceled = make(chan error, 1)
+
+
+// 等待 Num1 毫秒，期间 context 被取消则立即返回
+func (foo Foo) Sleep(ctx context.Context, args Args, reply *int) error {
+    select {
+    case <-time.After(time.Millisecond * time.Duration(args.Num1)):
+    case <-ctx.Done():
+        sleepCanceled <- ctx.Err()
+        return ctx.Err()
+    }
+    *reply = args.Num1 + args.Num2
+    return nil
+}
+
+
+// 不感知 context 的耗时方法，等待 Num1 毫秒
+func (foo Foo) Block(args Args, reply *int) error {
+    time.Sleep(time.Millisecond * time.Duration(args.Num1))
+    *reply = args.Num1 + args.Num2
+    return nil
+}
+
+
+func (foo Foo) Panic(args Args, reply *int) error {
+    var arr []int
+    *reply = arr[args.Num1]
+    return nil
+}
+
+
+func startTestServer(test *testing.T, opts ...*ServiceOption) string {
+    var foo Foo
+    server := NewServer()
+    if err := server.Register(&foo, opts...); err != nil {
+        test.Fatal("register error:", err)
+    }
+    return serveTestServer(test, server)
+}
+
+
+func serveTestServer(test *testing.T, server *Server) string {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        test.Fatal("network error:", err)
+    }
+    test.Cleanup(func() {
+        _ = listener.Close()
+    })
+
+    go server.Accept(listener)
+    return listener.Addr().String()
+}
+
+
+func TestCodecRoundTrip(test *testing.T) {
+    addr := startTestServer(test)
+    for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.FrameType} {
+        client, err := Dial("tcp", addr, &Option{CodecType: typ})
+        if err != nil {
+            test.Fatalf("%s: dial error: %v", typ, err)
+        }
+
+        for i := 0; i < 5; i++ {
+            var reply int
+            if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: i * i}, &reply); err != nil {
+                test.Fatalf("%s: call error: %v", typ, err)
+            }
+            if reply != i + i * i {
+                test.Fatalf("%s: expect %d, got %d", typ, i + i * i, reply)
+            }
+        }
+
+        var reply int
+        err = client.Call(context.Background(), "Foo.Unknown", &Args{}, &reply)
+        if err == nil {
+            test.Fatalf("%s: call to unknown method should fail", typ)
+        }
+        _ = client.Close()
+    }
+}
+
+
+func TestCallCancel(test *testing.T) {
+    addr := startTestServer(test)
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+
+    var reply int
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(time.Millisecond * 50, cancel)
+    if err := client.Call(ctx, "Foo.Sleep", &Args{Num1: 5000}, &reply); err == nil {
+        test.Fatal("canceled call should fail")
+    }
+    select {
+    case err := <-sleepCanceled:
+        if err != context.Canceled {
+            test.Fatal("expect context.Canceled on server, got", err)
+        }
+    case <-time.After(time.Second):
+        test.Fatal("server did not observe cancellation")
+    }
+
+    ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond * 50)
+    defer cancel()
+    _ = client.Call(ctx, "Foo.Sleep", &Args{Num1: 5000}, &reply)
+    select {
+    case err := <-sleepCanceled:
+        if err != context.DeadlineExceeded {
+            test.Fatal("expect context.DeadlineExceeded on server, got", err)
+        }
+    case <-time.After(time.Second):
+        test.Fatal("server did not observe deadline")
+    }
+
+    if err := client.Call(context.Background(), "Foo.Sleep", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+}
+
+
+// 客户端发送剩余的超时时间，服务端按自己的时钟计算截止时间，不受时钟偏差影响
+func TestRelativeTimeout(test *testing.T) {
+    calls := &inflight {
+        cancels: make(map[uint64]context.CancelFunc),
+        streams: make(map[uint64]*ServerStream),
+    }
+    ctx, cancel := calls.add(context.Background(), &codec.Header{Seq: 1, Timeout: int64(time.Minute)})
+    defer cancel()
+    deadline, ok := ctx.Deadline()
+    if left := time.Until(deadline); !ok || left > time.Minute || left < time.Second * 59 {
+        test.Fatal("unexpected deadline", deadline)
+    }
+
+    if remaining(time.Now().Add(-time.Second)) != 1 {
+        test.Fatal("an expired deadline should be sent as the minimum timeout")
+    }
+}
+
+
+func TestHandleTimeout(test *testing.T) {
+    addr := startTestServer(test, &ServiceOption{MethodTimeout: map[string]time.Duration{"Block": time.Millisecond * 50}})
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+
+    var reply int
+    start := time.Now()
+    err = client.Call(context.Background(), "Foo.Block", &Args{Num1: 300}, &reply)
+    if err == nil || !strings.Contains(err.Error(), "handle timeout") {
+        test.Fatal("expect a handle timeout error, got", err)
+    }
+    if time.Since(start) > time.Millisecond * 250 {
+        test.Fatal("timeout response should not wait for the handler")
+    }
+
+    // 处理函数返回后不会再发送第二个响应，连接上后续的请求不受影响
+    time.Sleep(time.Millisecond * 300)
+    for i := 0; i < 3; i++ {
+        if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply); err != nil || reply != i + 1 {
+            test.Fatalf("expect %d, got %d, error %v", i + 1, reply, err)
+        }
+    }
+
+    // 连接级别的 HandleTimeout 会取消处理函数的 context
+    client2, err := Dial("tcp", addr, &Option{HandleTimeout: time.Millisecond * 50})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client2.Close()
+    if err := client2.Call(context.Background(), "Foo.Sleep", &Args{Num1: 5000}, &reply); err == nil {
+        test.Fatal("expect a handle timeout error")
+    }
+    select {
+    case err := <-sleepCanceled:
+        if err != context.DeadlineExceeded {
+            test.Fatal("expect context.DeadlineExceeded on server, got", err)
+        }
+    case <-time.After(time.Second):
+        test.Fatal("server handler was not canceled on timeout")
+    }
+
+    server := NewServer()
+    var foo Foo
+    if err := server.Register(&foo, &ServiceOption{MethodTimeout: map[string]time.Duration{"Missing": time.Second}}); err == nil {
+        test.Fatal("register with unknown method timeout should fail")
+    }
+}
+
+
+func TestInterceptors(test *testing.T) {
+    var order []string
+    var mtx sync.Mutex
+    record := func(name string) {
+        mtx.Lock()
+        order = append(order, name)
+        mtx.Unlock()
+    }
+
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    server.Use(func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error {
+        record("server-1")
+        return next(ctx, header, argv, replyv)
+    }, func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error {
+        record("server-2")
+        if argv.(Args).Num1 < 0 {
+            return errors.New("rejected by interceptor")
+        }
+        err := next(ctx, header, argv, replyv)
+        *replyv.(*int) *= 10
+        return err
+    })
+    addr := serveTestServer(test, server)
+
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    client.Use(func(ctx context.Context, header *codec.Header, args, reply interface{}, next Invoker) error {
+        record("client")
+        header.ServiceMethod = "Foo.Sum"    // 拦截器可以改写请求
+        return next(ctx, header, args, reply)
+    })
+
+    var reply int
+    if err := client.Call(context.Background(), "Foo.Missing", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 30 {
+        test.Fatalf("expect 30, got %d, error %v", reply, err)
+    }
+    if strings.Join(order, ",") != "client,server-1,server-2" {
+        test.Fatal("unexpected interceptor order:", order)
+    }
+
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: -1}, &reply); err == nil || !strings.Contains(err.Error(), "rejected") {
+        test.Fatal("expect rejected error, got", err)
+    }
+
+    call := <-client.Go("Foo.Sum", &Args{Num1: 2, Num2: 3}, &reply, nil).Done
+    if call.Error != nil || reply != 50 {
+        test.Fatalf("expect 50, got %d, error %v", reply, call.Error)
+    }
+}
+
+
+func TestPanicRecovery(test *testing.T) {
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    addr := serveTestServer(test, server)
+
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+
+    var reply int
+    err = client.Call(context.Background(), "Foo.Panic", &Args{Num1: 1}, &reply)
+    if err == nil || !strings.Contains(err.Error(), "panic in Foo.Panic") {
+        test.Fatal("expect panic error, got", err)
+    }
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("server should keep serving after panic, got %d, error %v", reply, err)
+    }
+
+    _, mType, _ := server.findService("Foo.Panic")
+    if mType.NumPanics() != 1 || mType.NumCalls() != 1 {
+        test.Fatalf("expect 1 call and 1 panic, got %d and %d", mType.NumCalls(), mType.NumPanics())
+    }
+
+    w := httptest.NewRecorder()
+    debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath, nil))
+    if !strings.Contains(w.Body.String(), "Panics") {
+        test.Fatal("debug page should show panic statistics")
+    }
+
+    // 拦截器中的 panic 同样只影响当前请求
+    server.Use(func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error {
+        if argv.(Args).Num1 < 0 {
+            panic("bad interceptor")
+        }
+        return next(ctx, header, argv, replyv)
+    })
+    err = client.Call(context.Background(), "Foo.Sum", &Args{Num1: -1}, &reply)
+    if !errors.Is(err, Internal) || !strings.Contains(err.Error(), "panic in interceptor of Foo.Sum") {
+        test.Fatal("expect interceptor panic error, got", err)
+    }
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("server should keep serving after panic, got %d, error %v", reply, err)
+    }
+}
+
+
+func TestShutdown(test *testing.T) {
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    hooked := make(chan struct{})
+    server.RegisterOnShutdown(func() {
+        close(hooked)
+    })
+    addr := serveTestServer(test, server)
+
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+
+    // 正在处理的请求在关闭时可以正常完成
+    var reply int
+    call := client.Go("Foo.Block", &Args{Num1: 200, Num2: 1}, &reply, nil)
+    time.Sleep(time.Millisecond * 50)
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if err := server.Shutdown(ctx); err != nil {
+        test.Fatal("shutdown error:", err)
+    }
+    <-hooked
+
+    select {
+    case call := <-call.Done:
+        if call.Error != nil || reply != 201 {
+            test.Fatalf("expect 201, got %d, error %v", reply, call.Error)
+        }
+    case <-time.After(time.Second):
+        test.Fatal("in-flight call should finish")
+    }
+
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{}, &reply); err == nil {
+        test.Fatal("call after shutdown should fail")
+    }
+    if _, err := Dial("tcp", addr); err == nil {
+        test.Fatal("dial after shutdown should fail")
+    }
+}
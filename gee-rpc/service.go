@@ -1,22 +1,45 @@
 package geerpc
 
 import (
+    "context"
+    "errors"
+    "fmt"
     "reflect"
     "log"
     "go/ast"
     "sync/atomic"
+    "time"
 )
 
 /*
 func (t *T) MethodName(argType T1, replyType *T2) error
+func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+流式方法的签名见 stream.go
 */
 
 
+type methodKind int
+
+const (
+    unaryCall methodKind = iota
+    serverStreaming
+    clientStreaming
+    bidiStreaming
+)
+
+
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+
 type methodType struct {
     method reflect.Method       // 方法本身
     ArgType reflect.Type        // 第一个参数的类型
-    ReplyType reflect.Type      // 第二个参数的类型
+    ReplyType reflect.Type      // 第二个参数的类型，双向流没有第二个参数
+    hasCtx bool                 // 第一个参数是否为 context.Context
+    kind methodKind             // 普通调用或流式调用
+    timeout time.Duration       // 处理超时，0 表示不设限
     numCalls uint64             // 统计方法调用次数
+    numPanics uint64            // 统计方法发生 panic 的次数
 }
 
 
@@ -26,6 +49,11 @@ func (mt *methodType) NumCalls() uint64 {
 }
 
 
+func (mt *methodType) NumPanics() uint64 {
+    return atomic.LoadUint64(&mt.numPanics)
+}
+
+
 func (mt *methodType) newArgv() reflect.Value {
     var argv reflect.Value
     if mt.ArgType.Kind() == reflect.Ptr {
@@ -77,30 +105,69 @@ func (s *service) registerMethod() {
     for i := 0; i < s.typ.NumMethod(); i++ {
         method := s.typ.Method(i)
         mType := method.Type
-        // 3 个入参，第 0 个是自身 self，第 1 个 arg，第 2 个 reply
+        // 第 0 个入参是自身 self，之后是可选的 context.Context，再之后是 arg 和 reply
         // 1 个返回值，类型为 error
-        if mType.NumIn() != 3 || mType.NumOut() != 1 {
-            continue
-        }
-        if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+        if mType.NumOut() != 1 || mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
             continue
         }
 
-        argType, replyType := mType.In(1), mType.In(2)
-        if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
-            continue
+        params := make([]reflect.Type, 0, mType.NumIn())
+        for j := 1; j < mType.NumIn(); j++ {
+            params = append(params, mType.In(j))
+        }
+        hasCtx := len(params) > 0 && params[0] == typeOfContext
+        if hasCtx {
+            params = params[1:]
         }
 
-        s.method[method.Name] = &methodType {
+        m := &methodType {
             method: method,
-            ArgType: argType,
-            ReplyType: replyType,
+            hasCtx: hasCtx,
+        }
+        switch {
+        case len(params) == 1 && params[0] == typeOfServerStream:
+            m.kind = bidiStreaming
+            m.ArgType = params[0]
+        case len(params) != 2:
+            continue
+        case params[1] == typeOfServerStream:
+            m.kind = serverStreaming
+        case params[0] == typeOfServerStream:
+            m.kind = clientStreaming
+        }
+        if len(params) == 2 {
+            m.ArgType, m.ReplyType = params[0], params[1]
+            if !isExportedOrBuiltinType(m.ReplyType) {
+                continue
+            }
         }
+        if !isExportedOrBuiltinType(m.ArgType) {
+            continue
+        }
+
+        s.method[method.Name] = m
         log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
     }
 }
 
 
+func (s *service) setTimeout(opt *ServiceOption) error {
+    for name := range opt.MethodTimeout {
+        if s.method[name] == nil {
+            return errors.New("rpc server: can't find method " + s.name + "." + name)
+        }
+    }
+
+    for name, m := range s.method {
+        m.timeout = opt.HandleTimeout
+        if t, ok := opt.MethodTimeout[name]; ok {
+            m.timeout = t
+        }
+    }
+    return nil
+}
+
+
 func isExportedOrBuiltinType(t reflect.Type) bool {
     // exported 导出类型
     // 内置类型 这些类型没有包路径 t.PkgPath() == ""
@@ -108,10 +175,28 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 }
 
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) (err error) {
     atomic.AddUint64(&m.numCalls, 1)    // 函数调用次数+1
+    defer func() {
+        // 服务方法中的 panic 只影响当前请求，转换为错误返回给客户端
+        if r := recover(); r != nil {
+            atomic.AddUint64(&m.numPanics, 1)
+            msg := fmt.Sprintf("rpc server: panic in %s.%s: %v", s.name, m.method.Name, r)
+            log.Printf("%s\n\n", trace(msg))
+            err = NewError(Internal, msg)
+        }
+    } ()
+
     fun := m.method.Func
-    returnValues := fun.Call([]reflect.Value{s.rcvr, argv, replyv})
+    in := []reflect.Value{s.rcvr}
+    if m.hasCtx {
+        in = append(in, reflect.ValueOf(ctx))
+    }
+    in = append(in, argv)
+    if replyv.IsValid() {   // 双向流只有一个参数
+        in = append(in, replyv)
+    }
+    returnValues := fun.Call(in)
     
     if errInter := returnValues[0].Interface(); errInter != nil {
         return errInter.(error)
@@ -0,0 +1,122 @@
+package geerpc
+
+import (
+    "context"
+    "geerpc/codec"
+    "net"
+    "sync"
+)
+
+
+var ErrServerShutdown = NewError(Unavailable, "rpc server: server is shutting down")
+
+
+// 注册 Shutdown 开始时调用的函数，如从注册中心注销
+func (server *Server) RegisterOnShutdown(f func()) {
+    server.mtx.Lock()
+    defer server.mtx.Unlock()
+    server.onShutdown = append(server.onShutdown, f)
+}
+
+
+// 优雅关闭: 执行 RegisterOnShutdown 注册的函数，停止 Accept，拒绝新的请求，
+// 等待正在处理的请求完成后关闭所有连接。ctx 结束时不再等待，直接关闭连接并返回 ctx 的错误
+func (server *Server) Shutdown(ctx context.Context) error {
+    server.mtx.Lock()
+    if server.inShutdown {
+        server.mtx.Unlock()
+        return ErrServerShutdown
+    }
+    server.inShutdown = true
+    hooks := server.onShutdown
+    for listener := range server.listeners {
+        _ = listener.Close()
+    }
+    conns := make(map[codec.Codec]*sync.WaitGroup, len(server.conns))
+    for cc, wg := range server.conns {
+        conns[cc] = wg
+    }
+    server.mtx.Unlock()
+
+    for _, f := range hooks {
+        f()
+    }
+
+    // inShutdown 设置之后不会再有新的请求加入 WaitGroup
+    drained := make(chan struct{})
+    go func() {
+        for _, wg := range conns {
+            wg.Wait()
+        }
+        close(drained)
+    } ()
+
+    var err error
+    select {
+    case <-drained:
+    case <-ctx.Done():
+        err = ctx.Err()
+    }
+
+    for cc := range conns {
+        _ = cc.Close()
+    }
+    return err
+}
+
+
+func (server *Server) shuttingDown() bool {
+    server.mtx.Lock()
+    defer server.mtx.Unlock()
+    return server.inShutdown
+}
+
+
+// 关闭时不再接收新的请求，和 Shutdown 共用锁，保证 Shutdown 等待时不会再有新的请求加入
+func (server *Server) addRequest(wg *sync.WaitGroup) bool {
+    server.mtx.Lock()
+    defer server.mtx.Unlock()
+    if server.inShutdown {
+        return false
+    }
+    wg.Add(1)
+    return true
+}
+
+
+func (server *Server) trackListener(listener net.Listener, add bool) bool {
+    server.mtx.Lock()
+    defer server.mtx.Unlock()
+
+    if !add {
+        delete(server.listeners, listener)
+        return true
+    }
+    if server.inShutdown {
+        return false
+    }
+    if server.listeners == nil {
+        server.listeners = make(map[net.Listener]struct{})
+    }
+    server.listeners[listener] = struct{}{}
+    return true
+}
+
+
+func (server *Server) trackConn(cc codec.Codec, wg *sync.WaitGroup, add bool) bool {
+    server.mtx.Lock()
+    defer server.mtx.Unlock()
+
+    if !add {
+        delete(server.conns, cc)
+        return true
+    }
+    if server.inShutdown {
+        return false
+    }
+    if server.conns == nil {
+        server.conns = make(map[codec.Codec]*sync.WaitGroup)
+    }
+    server.conns[cc] = wg
+    return true
+}
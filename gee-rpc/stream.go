@@ -0,0 +1,544 @@
+package geerpc
+
+import (
+    "context"
+    "errors"
+    "geerpc/codec"
+    "io"
+    "log"
+    "reflect"
+    "sync"
+)
+
+/*
+流式方法的签名，context.Context 参数可选:
+func (t *T) MethodName(argType T1, stream *geerpc.ServerStream) error        服务端流
+func (t *T) MethodName(stream *geerpc.ServerStream, replyType *T2) error     客户端流
+func (t *T) MethodName(stream *geerpc.ServerStream) error                    双向流
+
+同一个 Seq 上的消息都带有 Stream 标记，第一条消息携带 ServiceMethod 建立流，
+EOS 表示发送方结束发送，服务端的 EOS 同时携带处理结果的错误信息。
+
+流上的消息先用 codec.MarshalBody 序列化为 []byte，读循环只读出 []byte 放入流的缓冲区，由 Recv 解码，
+接收方不调用 Recv 不会阻塞连接上的其他调用。
+流量控制按消息数计算: 每个方向初始可以发送 streamWindow 条消息，接收方每处理完一半窗口，
+通过 Header.Credit 告诉发送方可以继续发送的数量，发送方没有额度时 Send 阻塞。
+*/
+
+
+var ErrStreamClosed = errors.New("rpc stream: stream is closed")
+
+
+const streamWindow = 64
+
+
+// 客户端和服务端共用的流实现
+type stream struct {
+    seq uint64
+    typ codec.Type
+    read func(body interface{}) error
+    write func(header *codec.Header, body interface{}) error
+
+    msgs chan []byte            // 已收到还没有被 Recv 读取的消息
+    consumed int                // Recv 处理完还没有归还给发送方的额度
+    recvMtx sync.Mutex
+    recvDone chan struct{}      // 对端已结束发送
+    recvErr error
+    recvOnce sync.Once
+    done chan struct{}          // 本端不再接收，之后的消息直接丢弃
+    doneOnce sync.Once
+
+    sendMtx sync.Mutex
+    sendClosed bool
+    sendErr error               // 发送端被关闭的原因，为 nil 时返回 ErrStreamClosed
+    sendDone chan struct{}      // 不能再发送，唤醒等待额度的 Send
+    sendOnce sync.Once
+    creditMtx sync.Mutex
+    credits int                 // 还可以发送的消息数
+    creditAdded chan struct{}
+}
+
+
+func newStream(seq uint64, typ codec.Type, read func(interface{}) error, write func(*codec.Header, interface{}) error) *stream {
+    return &stream {
+        seq: seq,
+        typ: typ,
+        read: read,
+        write: write,
+        msgs: make(chan []byte, streamWindow),
+        recvDone: make(chan struct{}),
+        done: make(chan struct{}),
+        sendDone: make(chan struct{}),
+        credits: streamWindow,
+        creditAdded: make(chan struct{}, 1),
+    }
+}
+
+
+// 由连接的读循环调用，只把消息读入缓冲区，不会阻塞读循环
+func (s *stream) deliver(header *codec.Header) error {
+    if header.EOS {
+        err := s.read(nil)
+        if header.Error != "" {
+            s.finishRecv(headerError(header))
+        } else {
+            s.finishRecv(io.EOF)
+        }
+        return err
+    }
+    if header.Credit > 0 {
+        s.addCredit(int(header.Credit))
+        return s.read(nil)
+    }
+
+    var data []byte
+    if err := s.read(&data); err != nil {
+        return err
+    }
+    select {
+    case <-s.done:
+        // 本端已关闭，直接丢弃
+    case s.msgs <- data:
+    default:
+        // 对端没有遵守流量控制
+        s.finishRecv(errors.New("rpc stream: flow control window exceeded"))
+        s.close()
+    }
+    return nil
+}
+
+
+func (s *stream) recv(ctx context.Context, body interface{}) error {
+    select {
+    case <-s.done:
+        return ErrStreamClosed
+    default:
+    }
+
+    select {
+    case data := <-s.msgs:
+        return s.consume(data, body)
+    default:
+    }
+
+    select {
+    case data := <-s.msgs:
+        return s.consume(data, body)
+    case <-s.recvDone:
+        // 对端结束前发送的消息都已经在缓冲区中
+        select {
+        case data := <-s.msgs:
+            return s.consume(data, body)
+        default:
+            return s.recvErr
+        }
+    case <-s.done:
+        return ErrStreamClosed
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+
+// 解码一条消息，处理完一半窗口时归还额度
+func (s *stream) consume(data []byte, body interface{}) error {
+    s.recvMtx.Lock()
+    s.consumed++
+    credit := 0
+    if s.consumed >= streamWindow / 2 {
+        credit, s.consumed = s.consumed, 0
+    }
+    s.recvMtx.Unlock()
+
+    if credit > 0 {
+        s.sendMtx.Lock()
+        err := s.write(&codec.Header{Seq: s.seq, Stream: true, Credit: uint32(credit)}, invalidRequest)
+        s.sendMtx.Unlock()
+        if err != nil {
+            log.Println("rpc stream: send credit error:", err)
+        }
+    }
+    return codec.UnmarshalBody(s.typ, data, body)
+}
+
+
+func (s *stream) addCredit(n int) {
+    s.creditMtx.Lock()
+    s.credits += n
+    s.creditMtx.Unlock()
+
+    select {
+    case s.creditAdded <- struct{}{}:
+    default:
+    }
+}
+
+
+// 等待发送额度，没有额度时阻塞直到对端归还、本端关闭、发送端被关闭或 ctx 结束
+func (s *stream) acquireCredit(ctx context.Context) error {
+    for {
+        s.creditMtx.Lock()
+        if s.credits > 0 {
+            s.credits--
+            s.creditMtx.Unlock()
+            return nil
+        }
+        s.creditMtx.Unlock()
+
+        select {
+        case <-s.creditAdded:
+        case <-s.done:
+            return ErrStreamClosed
+        case <-s.sendDone:
+            return s.sendError()
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+
+// 发送一条消息，需要流量控制的额度
+func (s *stream) sendMessage(ctx context.Context, body interface{}) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if err := s.acquireCredit(ctx); err != nil {
+        return err
+    }
+    return s.sendEncoded(body)
+}
+
+
+func (s *stream) sendEncoded(body interface{}) error {
+    data, err := codec.MarshalBody(s.typ, body)
+    if err != nil {
+        return err
+    }
+    return s.send(&codec.Header{Seq: s.seq, Stream: true}, data)
+}
+
+
+func (s *stream) send(header *codec.Header, body interface{}) error {
+    s.sendMtx.Lock()
+    defer s.sendMtx.Unlock()
+
+    if s.sendClosed {
+        if s.sendErr != nil {
+            return s.sendErr
+        }
+        return ErrStreamClosed
+    }
+    if header.EOS {
+        s.sendClosed = true
+    }
+    return s.write(header, body)
+}
+
+
+// 对端已经结束整个流或者连接断开，之后的 Send 返回 err，等待额度的 Send 立即返回
+func (s *stream) closeSend(err error) {
+    s.sendOnce.Do(func() {
+        s.sendMtx.Lock()
+        s.sendClosed, s.sendErr = true, err
+        s.sendMtx.Unlock()
+        close(s.sendDone)
+    })
+}
+
+
+func (s *stream) sendError() error {
+    s.sendMtx.Lock()
+    defer s.sendMtx.Unlock()
+    if s.sendErr != nil {
+        return s.sendErr
+    }
+    return ErrStreamClosed
+}
+
+
+// 对端结束发送，err 为 io.EOF 表示正常结束
+func (s *stream) finishRecv(err error) {
+    s.recvOnce.Do(func() {
+        s.recvErr = err
+        close(s.recvDone)
+    })
+}
+
+
+func (s *stream) close() {
+    s.doneOnce.Do(func() {
+        close(s.done)
+    })
+}
+
+
+// 服务端流式方法使用的流
+type ServerStream struct {
+    *stream
+    ctx context.Context
+}
+
+
+func (ss *ServerStream) Context() context.Context {
+    return ss.ctx
+}
+
+
+func (ss *ServerStream) Send(body interface{}) error {
+    return ss.sendMessage(ss.ctx, body)
+}
+
+
+// 客户端结束发送后返回 io.EOF
+func (ss *ServerStream) Recv(body interface{}) error {
+    return ss.recv(ss.ctx, body)
+}
+
+
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil))
+
+
+func (f *inflight) addStream(seq uint64, ss *ServerStream) {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    f.streams[seq] = ss
+}
+
+
+func (f *inflight) removeStream(seq uint64) {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    delete(f.streams, seq)
+}
+
+
+// 把已建立的流上的消息交给对应的流，找不到则直接丢弃
+func (f *inflight) deliver(cc codec.Codec, header *codec.Header) error {
+    f.mtx.Lock()
+    ss := f.streams[header.Seq]
+    f.mtx.Unlock()
+
+    if ss == nil {
+        return cc.ReadBody(nil)
+    }
+    return ss.deliver(header)
+}
+
+
+func (server *Server) handleStream(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, calls *inflight) {
+    defer wg.Done()
+    defer req.cancel()
+
+    // 流通常是长连接，只使用注册方法时设定的超时
+    ctx := req.ctx
+    if t := req.mType.timeout; t > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, t)
+        defer cancel()
+    }
+    ss := req.stream
+    ss.ctx = ctx
+
+    var argv, replyv reflect.Value
+    switch req.mType.kind {
+    case serverStreaming:
+        argv, replyv = req.argv, reflect.ValueOf(ss)
+    case clientStreaming:
+        argv, replyv = reflect.ValueOf(ss), req.replyv
+    case bidiStreaming:
+        argv = reflect.ValueOf(ss)
+    }
+    err := req.svc.call(ctx, req.mType, argv, replyv)
+
+    calls.removeStream(req.header.Seq)
+    ss.close()
+
+    // 客户端流的 reply 作为最后一条消息发送，客户端此时只等待这一条消息，不需要额度
+    if err == nil && req.mType.kind == clientStreaming {
+        err = ss.sendEncoded(req.replyv.Interface())
+    }
+
+    eos := &codec.Header{Seq: ss.seq, Stream: true, EOS: true}
+    if err != nil {
+        setHeaderError(eos, err)
+    }
+    _ = ss.send(eos, invalidRequest)
+}
+
+
+// 客户端的流
+type Stream struct {
+    *stream
+    ServiceMethod string
+    client *Client
+    ctx context.Context
+}
+
+
+// 建立一个流，服务端流的 args 为请求参数，客户端流和双向流的 args 为 nil
+// 流在服务端结束或 ctx 被取消时关闭
+func (client *Client) NewStream(ctx context.Context, serviceMethod string, args interface{}) (*Stream, error) {
+    if !client.info.HasFeature(FeatureStream) {
+        return nil, errors.New("rpc client: server does not support streams")
+    }
+    st := &Stream {
+        ServiceMethod: serviceMethod,
+        client: client,
+        ctx: ctx,
+    }
+    seq, err := client.registerStream(st)
+    if err != nil {
+        return nil, err
+    }
+
+    header := &codec.Header{ServiceMethod: serviceMethod, Seq: seq, Stream: true, Metadata: OutgoingMetadata(ctx)}
+    if deadline, ok := ctx.Deadline(); ok && client.info.HasFeature(FeatureTimeout) {
+        header.Timeout = remaining(deadline)
+    }
+    if args == nil {
+        args = invalidRequest
+    }
+    if err := st.send(header, args); err != nil {
+        client.removeStream(seq)
+        return nil, err
+    }
+
+    go st.watch()
+    return st, nil
+}
+
+
+func (st *Stream) watch() {
+    select {
+    case <-st.ctx.Done():
+        if st.client.removeStream(st.seq) != nil {
+            st.client.sendCancel(st.seq)
+        }
+        st.finishRecv(NewError(CodeOf(st.ctx.Err()), "rpc client: stream closed: " + st.ctx.Err().Error()))
+        st.close()
+    case <-st.recvDone:
+    case <-st.done:
+    }
+}
+
+
+// 关闭流，之后收到的消息直接丢弃，服务端还没有结束时通知服务端取消
+func (st *Stream) Close() error {
+    if st.client.removeStream(st.seq) != nil {
+        st.client.sendCancel(st.seq)
+    }
+    st.finishRecv(ErrStreamClosed)
+    st.close()
+    return nil
+}
+
+
+func (st *Stream) Send(body interface{}) error {
+    return st.sendMessage(st.ctx, body)
+}
+
+
+// 通知服务端不会再发送消息
+func (st *Stream) CloseSend() error {
+    return st.send(&codec.Header{Seq: st.seq, Stream: true, EOS: true}, invalidRequest)
+}
+
+
+// 服务端正常结束时返回 io.EOF，处理出错时返回服务端的错误
+func (st *Stream) Recv(body interface{}) error {
+    return st.recv(st.ctx, body)
+}
+
+
+// 结束发送并读取客户端流的 reply
+func (st *Stream) CloseAndRecv(reply interface{}) error {
+    if err := st.CloseSend(); err != nil {
+        return err
+    }
+    if err := st.Recv(reply); err != nil {
+        if err == io.EOF {
+            err = errors.New("rpc client: stream closed without reply")
+        }
+        return err
+    }
+    if err := st.Recv(nil); err != io.EOF {
+        return err
+    }
+    return nil
+}
+
+
+func (client *Client) registerStream(st *Stream) (uint64, error) {
+    client.mtx.Lock()
+    defer client.mtx.Unlock()
+
+    if client.shutdown || client.closing {
+        return 0, ErrShutdown
+    }
+
+    seq := client.seq
+    client.seq++
+    st.stream = newStream(seq, client.opt.CodecType, client.cc.ReadBody, client.write)
+    client.streams[seq] = st
+    return seq, nil
+}
+
+
+func (client *Client) removeStream(seq uint64) *Stream {
+    client.mtx.Lock()
+    defer client.mtx.Unlock()
+
+    st := client.streams[seq]
+    delete(client.streams, seq)
+    return st
+}
+
+
+func (client *Client) write(header *codec.Header, body interface{}) error {
+    client.sending.Lock()
+    defer client.sending.Unlock()
+    return client.cc.Write(header, body)
+}
+
+
+// 由 receive 调用，处理流上的消息
+func (client *Client) receiveStream(header *codec.Header) error {
+    var st *Stream
+    if header.EOS {
+        st = client.removeStream(header.Seq)
+    } else {
+        client.mtx.Lock()
+        st = client.streams[header.Seq]
+        client.mtx.Unlock()
+    }
+
+    if st == nil {
+        return client.cc.ReadBody(nil)
+    }
+    err := st.deliver(header)
+    if err != nil && !header.EOS {
+        log.Println("rpc client: read stream body error:", err)
+    }
+    // 服务端的 EOS 表示整个调用已经结束，不会再归还额度，Send 返回服务端的错误
+    // 服务端收到客户端的 EOS 只是客户端结束发送，服务端仍然可以发送，所以只在客户端处理
+    if header.EOS {
+        sendErr := error(ErrStreamClosed)
+        if header.Error != "" {
+            sendErr = headerError(header)
+        }
+        st.closeSend(sendErr)
+    }
+    return err
+}
+
+
+// 连接断开时结束所有的流，需要持有 client.mtx
+func (client *Client) terminateStreams(err error) {
+    for seq, st := range client.streams {
+        st.finishRecv(err)
+        st.closeSend(err)
+        delete(client.streams, seq)
+    }
+}
+
@@ -0,0 +1,311 @@
+package geerpc
+
+import (
+    "context"
+    "errors"
+    "geerpc/codec"
+    "io"
+    "strings"
+    "testing"
+    "time"
+)
+
+
+// 服务端流，依次返回 0 ~ Num1-1，Num2 < 0 时中途返回错误
+func (foo Foo) Count(args Args, stream *ServerStream) error {
+    for i := 0; i < args.Num1; i++ {
+        if args.Num2 < 0 && i == 2 {
+            return errors.New("count failed")
+        }
+        if err := stream.Send(i); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+
+// 客户端流，返回所有数字的和
+func (foo Foo) Total(stream *ServerStream, reply *int) error {
+    for {
+        var n int
+        err := stream.Recv(&n)
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        *reply += n
+    }
+}
+
+
+// 双向流，收到的数字乘 2 后返回
+func (foo Foo) Double(stream *ServerStream) error {
+    for {
+        var n int
+        err := stream.Recv(&n)
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if err := stream.Send(n * 2); err != nil {
+            return err
+        }
+    }
+}
+
+
+// 客户端流，不读取消息直接返回错误
+func (foo Foo) Reject(stream *ServerStream, reply *int) error {
+    return errors.New("rejected")
+}
+
+
+// 客户端流，不读取消息，直到被取消
+func (foo Foo) Hold(ctx context.Context, stream *ServerStream, reply *int) error {
+    <-ctx.Done()
+    return ctx.Err()
+}
+
+
+// 一直发送，直到客户端取消
+func (foo Foo) Tail(ctx context.Context, args Args, stream *ServerStream) error {
+    for i := 0; ; i++ {
+        select {
+        case <-ctx.Done():
+            sleepCanceled <- ctx.Err()
+            return ctx.Err()
+        case <-time.After(time.Millisecond * 10):
+        }
+        if err := stream.Send(i); err != nil {
+            return err
+        }
+    }
+}
+
+
+func TestStreams(test *testing.T) {
+    addr := startTestServer(test)
+    for _, typ := range []codec.Type{codec.GobType, codec.JsonType, codec.FrameType} {
+        client, err := Dial("tcp", addr, &Option{CodecType: typ})
+        if err != nil {
+            test.Fatalf("%s: dial error: %v", typ, err)
+        }
+
+        stream, err := client.NewStream(context.Background(), "Foo.Count", &Args{Num1: 5})
+        if err != nil {
+            test.Fatalf("%s: new stream error: %v", typ, err)
+        }
+        for i := 0; ; i++ {
+            var n int
+            err := stream.Recv(&n)
+            if err == io.EOF {
+                if i != 5 {
+                    test.Fatalf("%s: expect 5 messages, got %d", typ, i)
+                }
+                break
+            }
+            if err != nil || n != i {
+                test.Fatalf("%s: expect %d, got %d, error %v", typ, i, n, err)
+            }
+        }
+
+        stream, _ = client.NewStream(context.Background(), "Foo.Count", &Args{Num1: 5, Num2: -1})
+        var n int
+        for err = stream.Recv(&n); err == nil; err = stream.Recv(&n) {
+        }
+        if !strings.Contains(err.Error(), "count failed") {
+            test.Fatalf("%s: expect server error, got %v", typ, err)
+        }
+
+        stream, _ = client.NewStream(context.Background(), "Foo.Total", nil)
+        for i := 1; i <= 4; i++ {
+            if err := stream.Send(i); err != nil {
+                test.Fatalf("%s: send error: %v", typ, err)
+            }
+        }
+        var total int
+        if err := stream.CloseAndRecv(&total); err != nil || total != 10 {
+            test.Fatalf("%s: expect 10, got %d, error %v", typ, total, err)
+        }
+
+        stream, _ = client.NewStream(context.Background(), "Foo.Double", nil)
+        for i := 1; i <= 3; i++ {
+            var n int
+            if err := stream.Send(i); err != nil {
+                test.Fatalf("%s: send error: %v", typ, err)
+            }
+            if err := stream.Recv(&n); err != nil || n != i * 2 {
+                test.Fatalf("%s: expect %d, got %d, error %v", typ, i * 2, n, err)
+            }
+        }
+        _ = stream.CloseSend()
+        if err := stream.Recv(&n); err != io.EOF {
+            test.Fatalf("%s: expect io.EOF, got %v", typ, err)
+        }
+
+        // 流和普通调用可以在同一个连接上交替进行
+        var reply int
+        if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+            test.Fatalf("%s: expect 3, got %d, error %v", typ, reply, err)
+        }
+        _ = client.Close()
+    }
+}
+
+
+func TestStreamCancel(test *testing.T) {
+    addr := startTestServer(test)
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    stream, err := client.NewStream(ctx, "Foo.Tail", &Args{})
+    if err != nil {
+        test.Fatal("new stream error:", err)
+    }
+    for i := 0; i < 3; i++ {
+        var n int
+        if err := stream.Recv(&n); err != nil || n != i {
+            test.Fatalf("expect %d, got %d, error %v", i, n, err)
+        }
+    }
+    cancel()
+
+    select {
+    case err := <-sleepCanceled:
+        if err != context.Canceled {
+            test.Fatal("expect context.Canceled on server, got", err)
+        }
+    case <-time.After(time.Second):
+        test.Fatal("server did not observe stream cancellation")
+    }
+
+    var reply int
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+    if err := client.Call(context.Background(), "Foo.Count", &Args{Num1: 1}, &reply); err == nil {
+        test.Fatal("unary call to a stream method should fail")
+    }
+}
+
+
+func TestStreamFlowControl(test *testing.T) {
+    addr := startTestServer(test)
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+
+    // 不读取的流不会阻塞连接上的其他调用
+    idle, err := client.NewStream(context.Background(), "Foo.Count", &Args{Num1: streamWindow * 10})
+    if err != nil {
+        test.Fatal("new stream error:", err)
+    }
+    time.Sleep(time.Millisecond * 100)
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    var reply int
+    if err := client.Call(ctx, "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+
+    // 超过窗口的消息在读取后归还额度，可以全部收到
+    stream, err := client.NewStream(context.Background(), "Foo.Count", &Args{Num1: streamWindow * 10})
+    if err != nil {
+        test.Fatal("new stream error:", err)
+    }
+    count := 0
+    for {
+        var n int
+        err := stream.Recv(&n)
+        if err == io.EOF {
+            break
+        }
+        if err != nil || n != count {
+            test.Fatalf("expect %d, got %d, error %v", count, n, err)
+        }
+        count++
+    }
+    if count != streamWindow * 10 {
+        test.Fatalf("expect %d messages, got %d", streamWindow * 10, count)
+    }
+
+    // Close 之后流从客户端移除，Recv 返回 ErrStreamClosed
+    if err := idle.Close(); err != nil {
+        test.Fatal("close error:", err)
+    }
+    var n int
+    if err := idle.Recv(&n); err != ErrStreamClosed {
+        test.Fatal("expect ErrStreamClosed, got", err)
+    }
+    if pending := client.NumPending(); pending != 0 {
+        test.Fatal("closed stream should be removed, pending", pending)
+    }
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 2, Num2: 2}, &reply); err != nil || reply != 4 {
+        test.Fatalf("expect 4, got %d, error %v", reply, err)
+    }
+}
+
+
+// 额度用完后服务端已经结束或者连接断开，Send 不会一直阻塞
+func TestStreamSendAfterPeerDone(test *testing.T) {
+    addr := startTestServer(test)
+    client, err := Dial("tcp", addr)
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+
+    sendAll := func(stream *Stream) chan error {
+        result := make(chan error, 1)
+        go func() {
+            for i := 0; i < streamWindow * 3; i++ {
+                if err := stream.Send(i); err != nil {
+                    result <- err
+                    return
+                }
+            }
+            result <- nil
+        } ()
+        return result
+    }
+
+    stream, err := client.NewStream(context.Background(), "Foo.Reject", nil)
+    if err != nil {
+        test.Fatal("new stream error:", err)
+    }
+    select {
+    case err := <-sendAll(stream):
+        if err == nil || !strings.Contains(err.Error(), "rejected") {
+            test.Fatal("expect the server error, got", err)
+        }
+    case <-time.After(time.Second * 3):
+        test.Fatal("send should stop after the server ended the stream")
+    }
+
+    stream, err = client.NewStream(context.Background(), "Foo.Hold", nil)
+    if err != nil {
+        test.Fatal("new stream error:", err)
+    }
+    result := sendAll(stream)
+    time.Sleep(time.Millisecond * 100)
+    _ = client.Close()
+    select {
+    case err := <-result:
+        if err == nil {
+            test.Fatal("send should fail after the connection is closed")
+        }
+    case <-time.After(time.Second * 3):
+        test.Fatal("send should stop after the connection is closed")
+    }
+}
@@ -0,0 +1,69 @@
+package geerpc
+
+import (
+    "context"
+    "crypto/tls"
+    "io"
+    "net"
+)
+
+/*
+TLS 在建立连接之后、Option 协商之前完成握手:
+客户端在 Option.TLSConfig 不为 nil 时使用 TLS，XDial 的 tls@host:port 地址总是使用 TLS
+服务端使用 AcceptTLS，config.ClientAuth 设置为 tls.RequireAndVerifyClientCert 时为双向认证，
+客户端证书可以在服务方法和拦截器中通过 TLSState(ctx) 获取
+*/
+
+
+type tlsStateKey struct{}
+
+
+// 返回请求所在连接的 TLS 状态，对端证书在 PeerCertificates 中，非 TLS 连接返回 nil
+func TLSState(ctx context.Context) *tls.ConnectionState {
+    state, _ := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+    return state
+}
+
+
+// 在 listener 上接受 TLS 连接
+func (server *Server) AcceptTLS(listener net.Listener, config *tls.Config) {
+    server.Accept(tls.NewListener(listener, config))
+}
+
+
+func AcceptTLS(listener net.Listener, config *tls.Config) {
+    DefaultServer.AcceptTLS(listener, config)
+}
+
+
+// 服务端完成 TLS 握手，把连接的 TLS 状态放入 ctx，非 TLS 连接直接返回 ctx
+func serverTLS(ctx context.Context, conn io.ReadWriteCloser) (context.Context, error) {
+    tlsConn, ok := conn.(*tls.Conn)
+    if !ok {
+        return ctx, nil
+    }
+    if err := tlsConn.Handshake(); err != nil {
+        return nil, err
+    }
+    state := tlsConn.ConnectionState()
+    return context.WithValue(ctx, tlsStateKey{}, &state), nil
+}
+
+
+// 客户端完成 TLS 握手，没有设置 ServerName 时使用 address 中的主机名校验服务端证书
+func clientTLS(conn net.Conn, address string, config *tls.Config) (net.Conn, error) {
+    if config.ServerName == "" && !config.InsecureSkipVerify {
+        host, _, err := net.SplitHostPort(address)
+        if err != nil {
+            host = address
+        }
+        config = config.Clone()
+        config.ServerName = host
+    }
+
+    tlsConn := tls.Client(conn, config)
+    if err := tlsConn.Handshake(); err != nil {
+        return nil, err
+    }
+    return tlsConn, nil
+}
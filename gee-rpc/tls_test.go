@@ -0,0 +1,118 @@
+package geerpc
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "errors"
+    "math/big"
+    "net"
+    "testing"
+    "time"
+)
+
+
+// 返回调用方客户端证书的 CommonName
+func (foo Foo) Whoami(ctx context.Context, args Args, reply *string) error {
+    state := TLSState(ctx)
+    if state == nil || len(state.PeerCertificates) == 0 {
+        return errors.New("no client certificate")
+    }
+    *reply = state.PeerCertificates[0].Subject.CommonName
+    return nil
+}
+
+
+// 生成证书，parent 为 nil 时生成自签名的 CA
+func newTestCert(test *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        test.Fatal("generate key error:", err)
+    }
+    template := &x509.Certificate {
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject: pkix.Name{CommonName: name},
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+        ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+    }
+
+    signer, signerKey := template, interface{}(key)
+    if parent == nil {
+        template.IsCA = true
+        template.BasicConstraintsValid = true
+    } else {
+        signer, signerKey = parent.Leaf, parent.PrivateKey
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+    if err != nil {
+        test.Fatal("create certificate error:", err)
+    }
+    leaf, _ := x509.ParseCertificate(der)
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+
+func TestMutualTLS(test *testing.T) {
+    ca := newTestCert(test, "test-ca", nil)
+    pool := x509.NewCertPool()
+    pool.AddCert(ca.Leaf)
+    serverCert, clientCert := newTestCert(test, "server", &ca), newTestCert(test, "client-1", &ca)
+
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        test.Fatal("network error:", err)
+    }
+    defer listener.Close()
+    go server.AcceptTLS(listener, &tls.Config {
+        Certificates: []tls.Certificate{serverCert},
+        ClientCAs: pool,
+        ClientAuth: tls.RequireAndVerifyClientCert,
+    })
+    addr := "tls@" + listener.Addr().String()
+
+    client, err := XDial(addr, &Option{TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}})
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    var name string
+    if err := client.Call(context.Background(), "Foo.Whoami", &Args{}, &name); err != nil || name != "client-1" {
+        test.Fatalf("expect client-1, got %q, error %v", name, err)
+    }
+    var reply int
+    if err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+
+    // 没有客户端证书、不信任服务端证书和明文连接都无法完成调用
+    for _, opt := range []*Option {
+        {TLSConfig: &tls.Config{RootCAs: pool}},
+        {TLSConfig: &tls.Config{Certificates: []tls.Certificate{clientCert}}},
+        {},
+    } {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        rpcAddr := addr
+        if opt.TLSConfig == nil {
+            rpcAddr = "tcp@" + listener.Addr().String()
+        }
+        client, err := XDial(rpcAddr, opt)
+        if err == nil {
+            err = client.Call(ctx, "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+            _ = client.Close()
+        }
+        cancel()
+        if err == nil {
+            test.Fatalf("call with option %+v should fail", opt)
+        }
+    }
+}
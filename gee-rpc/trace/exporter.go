@@ -0,0 +1,82 @@
+package trace
+
+import (
+    "encoding/json"
+    "os"
+    "sync"
+)
+
+
+// 接收结束的 span，需要支持并发调用
+type Exporter interface {
+    Export(span *Span)
+}
+
+
+// 在内存中保存所有 span，用于测试和调试
+type MemoryExporter struct {
+    mtx sync.Mutex
+    spans []*Span
+}
+
+
+func NewMemoryExporter() *MemoryExporter {
+    return &MemoryExporter{}
+}
+
+
+func (e *MemoryExporter) Export(span *Span) {
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    e.spans = append(e.spans, span)
+}
+
+
+// 按结束顺序返回所有 span
+func (e *MemoryExporter) Spans() []*Span {
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    return append([]*Span(nil), e.spans...)
+}
+
+
+func (e *MemoryExporter) Reset() {
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    e.spans = nil
+}
+
+
+// 每个 span 作为一行 JSON 追加到文件，多个进程可以写同一个文件
+type FileExporter struct {
+    mtx sync.Mutex
+    file *os.File
+}
+
+
+func NewFileExporter(path string) (*FileExporter, error) {
+    file, err := os.OpenFile(path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &FileExporter{file: file}, nil
+}
+
+
+func (e *FileExporter) Export(span *Span) {
+    data, err := json.Marshal(span)
+    if err != nil {
+        return
+    }
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    // 一次写入整行，O_APPEND 保证多个进程的写入不会交错
+    _, _ = e.file.Write(append(data, '\n'))
+}
+
+
+func (e *FileExporter) Close() error {
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    return e.file.Close()
+}
@@ -0,0 +1,214 @@
+package trace
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+/*
+按 W3C Trace Context 传播调用链: traceparent = 00-<trace id>-<parent span id>-<flags>
+geerpc 通过请求的元数据 (Header.Metadata["traceparent"]) 传递，gee 通过 HTTP 请求头传递，
+两边使用同一个 trace id，导出的 span 可以按 trace id 关联起来。
+*/
+
+
+const TraceparentKey = "traceparent"
+
+
+// 调用链中一个 span 的标识，可以在进程间传递
+type SpanContext struct {
+    TraceID [16]byte
+    SpanID [8]byte
+    Flags byte
+}
+
+
+func (sc SpanContext) IsValid() bool {
+    return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+
+// flags 的最低位表示上游决定记录该调用链
+func (sc SpanContext) Sampled() bool {
+    return sc.Flags & 1 == 1
+}
+
+
+func (sc SpanContext) Traceparent() string {
+    return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+
+// 解析 traceparent，格式错误或者 id 全为 0 时返回 false
+func ParseTraceparent(s string) (SpanContext, bool) {
+    var sc SpanContext
+    parts := strings.Split(strings.TrimSpace(s), "-")
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+        return sc, false
+    }
+    var flags [1]byte
+    if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) || !decodeHex(flags[:], parts[3]) {
+        return sc, false
+    }
+    sc.Flags = flags[0]
+    return sc, sc.IsValid()
+}
+
+
+func decodeHex(dst []byte, s string) bool {
+    if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+        return false
+    }
+    _, err := hex.Decode(dst, []byte(s))
+    return err == nil
+}
+
+
+type spanContextKey struct{}
+
+
+// 在 ctx 中设置当前的 span，之后创建的 span 作为它的子 span
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+    return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+
+// 使用其他进程传来的 traceparent 作为父 span，格式错误时返回原来的 ctx
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+    if sc, ok := ParseTraceparent(traceparent); ok {
+        return ContextWithSpanContext(ctx, sc)
+    }
+    return ctx
+}
+
+
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+    sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+    return sc, ok && sc.IsValid()
+}
+
+
+// 导出的 span，id 都是十六进制字符串，gee 导出的 span 使用相同的字段
+type Span struct {
+    TraceID string
+    SpanID string
+    ParentID string `json:",omitempty"`
+    Name string
+    Kind string                 // client, server
+    Start time.Time
+    End time.Time
+    Attributes map[string]string `json:",omitempty"`
+    Error string `json:",omitempty"`
+
+    tracer *Tracer
+    sc SpanContext
+    mtx sync.Mutex
+    ended bool
+}
+
+
+func (span *Span) SpanContext() SpanContext {
+    return span.sc
+}
+
+
+// 设置属性，span 结束后调用时忽略
+func (span *Span) SetAttribute(key, value string) {
+    span.mtx.Lock()
+    defer span.mtx.Unlock()
+
+    if span.ended {
+        return
+    }
+    if span.Attributes == nil {
+        span.Attributes = make(map[string]string)
+    }
+    span.Attributes[key] = value
+}
+
+
+// 结束 span 并导出，err 不为 nil 时记录错误，重复调用时忽略
+// 导出的是结束时的副本，之后对 span 的修改不影响 Exporter；没有采样的 span 不导出
+func (span *Span) Finish(err error) {
+    span.mtx.Lock()
+    if span.ended {
+        span.mtx.Unlock()
+        return
+    }
+    span.ended = true
+    span.End = time.Now()
+    if err != nil {
+        span.Error = err.Error()
+    }
+    snapshot := span.snapshot()
+    span.mtx.Unlock()
+
+    if span.tracer.exporter != nil && span.sc.Sampled() {
+        span.tracer.exporter.Export(snapshot)
+    }
+}
+
+
+// 复制导出的字段，需要持有 span.mtx
+func (span *Span) snapshot() *Span {
+    s := &Span {
+        TraceID: span.TraceID,
+        SpanID: span.SpanID,
+        ParentID: span.ParentID,
+        Name: span.Name,
+        Kind: span.Kind,
+        Start: span.Start,
+        End: span.End,
+        Error: span.Error,
+        sc: span.sc,
+        ended: true,
+    }
+    if span.Attributes != nil {
+        s.Attributes = make(map[string]string, len(span.Attributes))
+        for k, v := range span.Attributes {
+            s.Attributes[k] = v
+        }
+    }
+    return s
+}
+
+
+// 创建 span 并导出到 Exporter
+type Tracer struct {
+    exporter Exporter
+}
+
+
+func NewTracer(exporter Exporter) *Tracer {
+    return &Tracer{exporter: exporter}
+}
+
+
+// 创建一个 span，ctx 中有父 span 时属于同一个调用链并沿用父 span 的采样标记，否则开始新的调用链
+// 返回的 ctx 中当前 span 为新创建的 span
+func (t *Tracer) Start(ctx context.Context, name, kind string) (context.Context, *Span) {
+    span := &Span {
+        Name: name,
+        Kind: kind,
+        Start: time.Now(),
+        tracer: t,
+    }
+    if parent, ok := SpanContextFromContext(ctx); ok {
+        span.sc.TraceID = parent.TraceID
+        span.sc.Flags = parent.Flags
+        span.ParentID = hex.EncodeToString(parent.SpanID[:])
+    } else {
+        _, _ = rand.Read(span.sc.TraceID[:])
+        span.sc.Flags = 1       // sampled
+    }
+    _, _ = rand.Read(span.sc.SpanID[:])
+    span.TraceID = hex.EncodeToString(span.sc.TraceID[:])
+    span.SpanID = hex.EncodeToString(span.sc.SpanID[:])
+
+    return ContextWithSpanContext(ctx, span.sc), span
+}
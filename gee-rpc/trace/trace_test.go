@@ -0,0 +1,112 @@
+package trace
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+
+func TestTraceparent(test *testing.T) {
+    const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+    sc, ok := ParseTraceparent(tp)
+    if !ok || sc.Traceparent() != tp {
+        test.Fatalf("unexpected span context %+v", sc)
+    }
+    for _, s := range []string{
+        "",
+        "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+        "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+        "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+        "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+    } {
+        if _, ok := ParseTraceparent(s); ok {
+            test.Fatal("expect invalid traceparent:", s)
+        }
+    }
+}
+
+
+func TestFileExporter(test *testing.T) {
+    path := filepath.Join(test.TempDir(), "spans.json")
+    exporter, err := NewFileExporter(path)
+    if err != nil {
+        test.Fatal("open exporter error:", err)
+    }
+    tracer := NewTracer(exporter)
+
+    ctx, parent := tracer.Start(context.Background(), "parent", "server")
+    _, child := tracer.Start(ctx, "child", "client")
+    child.Finish(errors.New("failed"))
+    child.Finish(nil)       // 重复结束不会再次导出
+    parent.Finish(nil)
+    _ = exporter.Close()
+
+    file, err := os.Open(path)
+    if err != nil {
+        test.Fatal("open file error:", err)
+    }
+    defer file.Close()
+    var spans []*Span
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        span := &Span{}
+        if err := json.Unmarshal(scanner.Bytes(), span); err != nil {
+            test.Fatal("decode span error:", err)
+        }
+        spans = append(spans, span)
+    }
+    if len(spans) != 2 || spans[0].Name != "child" || spans[0].Error != "failed" {
+        test.Fatalf("unexpected spans %+v", spans)
+    }
+    if spans[0].TraceID != spans[1].TraceID || spans[0].ParentID != spans[1].SpanID || spans[1].ParentID != "" {
+        test.Fatalf("spans are not in the same trace: %+v", spans)
+    }
+}
+
+
+func TestExportSnapshot(test *testing.T) {
+    exporter := NewMemoryExporter()
+    tracer := NewTracer(exporter)
+
+    _, span := tracer.Start(context.Background(), "Foo.Sum", "client")
+    span.SetAttribute("rpc.code", "OK")
+    span.Finish(nil)
+    span.SetAttribute("rpc.code", "Internal")   // 结束后的修改被忽略
+    spans := exporter.Spans()
+    if len(spans) != 1 || spans[0] == span || spans[0].Attributes["rpc.code"] != "OK" || span.Attributes["rpc.code"] != "OK" {
+        test.Fatalf("unexpected exported spans %+v", spans)
+    }
+
+    // 上游没有采样的调用链不导出，并把标记传给下游
+    exporter.Reset()
+    ctx := ContextWithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+    _, span = tracer.Start(ctx, "Foo.Sum", "server")
+    span.Finish(nil)
+    if len(exporter.Spans()) != 0 || span.SpanContext().Sampled() {
+        test.Fatal("unsampled span should not be exported")
+    }
+}
+
+
+// gee 的 testdata/span.json 是同一份样例，修改字段时两边一起修改，保证导出的 span 字段相同
+func TestSpanSchema(test *testing.T) {
+    fixture, err := os.ReadFile(filepath.Join("testdata", "span.json"))
+    if err != nil {
+        test.Fatal("read fixture error:", err)
+    }
+    fixture = bytes.TrimSpace(fixture)
+    span := &Span{}
+    if err := json.Unmarshal(fixture, span); err != nil {
+        test.Fatal("decode span error:", err)
+    }
+    data, _ := json.Marshal(span)
+    if !bytes.Equal(data, fixture) {
+        test.Fatalf("span schema changed:\n%s\n%s", data, fixture)
+    }
+}
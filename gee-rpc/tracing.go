@@ -0,0 +1,48 @@
+package geerpc
+
+import (
+    "context"
+    "geerpc/codec"
+    rpctrace "geerpc/trace"     // 和 recovery.go 中的 trace 函数区分
+    "strconv"
+)
+
+
+// 为每次调用创建客户端 span，并通过元数据把 traceparent 传给服务端
+// ctx 中有当前 span 时 (如服务方法的 ctx 或 trace.ContextWithTraceparent) 属于同一个调用链
+func ClientTracing(tracer *rpctrace.Tracer) ClientInterceptor {
+    return func(ctx context.Context, header *codec.Header, args, reply interface{}, next Invoker) error {
+        ctx, span := tracer.Start(ctx, header.ServiceMethod, "client")
+        if header.Metadata == nil {
+            header.Metadata = make(map[string]string)
+        }
+        header.Metadata[rpctrace.TraceparentKey] = span.SpanContext().Traceparent()
+
+        err := next(ctx, header, args, reply)
+
+        if err != nil {
+            span.SetAttribute("rpc.code", CodeOf(err).String())
+        }
+        span.Finish(err)
+        return err
+    }
+}
+
+
+// 为每个请求创建服务端 span，父 span 来自客户端发来的 traceparent
+// 服务方法的 ctx 中当前 span 为该 span，用同一个 ctx 发起的调用属于同一个调用链
+func ServerTracing(tracer *rpctrace.Tracer) ServerInterceptor {
+    return func(ctx context.Context, header *codec.Header, argv, replyv interface{}, next Handler) error {
+        ctx = rpctrace.ContextWithTraceparent(ctx, header.Metadata[rpctrace.TraceparentKey])
+        ctx, span := tracer.Start(ctx, header.ServiceMethod, "server")
+        span.SetAttribute("rpc.seq", strconv.FormatUint(header.Seq, 10))
+
+        err := next(ctx, header, argv, replyv)
+
+        if err != nil {
+            span.SetAttribute("rpc.code", CodeOf(err).String())
+        }
+        span.Finish(err)
+        return err
+    }
+}
@@ -0,0 +1,62 @@
+package geerpc
+
+import (
+    "context"
+    "encoding/hex"
+    rpctrace "geerpc/trace"
+    "testing"
+)
+
+
+func (foo Foo) TraceID(ctx context.Context, args Args, reply *string) error {
+    sc, _ := rpctrace.SpanContextFromContext(ctx)
+    *reply = hex.EncodeToString(sc.TraceID[:])
+    return nil
+}
+
+
+func TestTracing(test *testing.T) {
+    exporter := rpctrace.NewMemoryExporter()
+    tracer := rpctrace.NewTracer(exporter)
+
+    var foo Foo
+    server := NewServer()
+    _ = server.Register(&foo)
+    server.Use(ServerTracing(tracer))
+    client, err := Dial("tcp", serveTestServer(test, server))
+    if err != nil {
+        test.Fatal("dial error:", err)
+    }
+    defer client.Close()
+    client.Use(ClientTracing(tracer))
+
+    // 模拟 gee 转发过来的 traceparent
+    ctx := rpctrace.ContextWithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    var reply string
+    if err := client.Call(ctx, "Foo.TraceID", &Args{}, &reply); err != nil || reply != "4bf92f3577b34da6a3ce929d0e0e4736" {
+        test.Fatalf("unexpected trace id %q, error %v", reply, err)
+    }
+
+    spans := exporter.Spans()
+    if len(spans) != 2 || spans[0].Kind != "server" || spans[1].Kind != "client" {
+        test.Fatalf("unexpected spans %+v", spans)
+    }
+    serverSpan, clientSpan := spans[0], spans[1]
+    if clientSpan.TraceID != reply || clientSpan.ParentID != "00f067aa0ba902b7" {
+        test.Fatalf("unexpected client span %+v", clientSpan)
+    }
+    if serverSpan.TraceID != reply || serverSpan.ParentID != clientSpan.SpanID || serverSpan.Name != "Foo.TraceID" {
+        test.Fatalf("unexpected server span %+v", serverSpan)
+    }
+
+    // 没有父 span 时开始新的调用链，错误记录在 span 中
+    exporter.Reset()
+    var n int
+    if err := client.Call(context.Background(), "Foo.Missing", &Args{}, &n); err == nil {
+        test.Fatal("expect error for missing method")
+    }
+    spans = exporter.Spans()
+    if len(spans) != 1 || spans[0].ParentID != "" || spans[0].Error == "" || spans[0].Attributes["rpc.code"] != "NotFound" {
+        test.Fatalf("unexpected spans %+v", spans)
+    }
+}
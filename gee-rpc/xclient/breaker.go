@@ -0,0 +1,235 @@
+package xclient
+
+import (
+    "context"
+    "errors"
+    . "geerpc"
+    "sort"
+    "sync"
+    "time"
+)
+
+/*
+熔断器按实例统计调用结果:
+closed      正常调用，连续失败 MaxFailures 次后打开
+open        选择实例时跳过，经过 OpenTimeout 后允许一个探测请求，进入 half-open
+half-open   探测请求成功则关闭熔断，失败则重新打开
+连接错误、超时和超过 SlowThreshold 的调用计为失败，服务端返回的错误不计入。
+调用方主动取消的调用 (如 Hedging 中落后的请求) 不计入任何结果，只释放 half-open 的探测名额。
+*/
+
+
+var ErrCircuitOpen = errors.New("rpc xclient: circuit breaker is open")
+
+
+type BreakerOption struct {
+    MaxFailures int             // 连续失败多少次后打开熔断
+    OpenTimeout time.Duration   // 打开后经过多久允许探测
+    SlowThreshold time.Duration // 耗时超过该值的调用计为失败，为 0 时不判断
+}
+
+
+var DefaultBreakerOption = &BreakerOption {
+    MaxFailures: 5,
+    OpenTimeout: time.Second * 10,
+}
+
+
+type CircuitState int
+
+
+const (
+    CircuitClosed CircuitState = iota
+    CircuitOpen
+    CircuitHalfOpen
+)
+
+
+func (s CircuitState) String() string {
+    switch s {
+    case CircuitOpen:
+        return "open"
+    case CircuitHalfOpen:
+        return "half-open"
+    default:
+        return "closed"
+    }
+}
+
+
+// 实例的调用统计
+type BackendStats struct {
+    Addr string
+    State CircuitState
+    Calls uint64
+    Errors uint64
+    Latency time.Duration      // 最近调用耗时的指数加权平均
+}
+
+
+type breaker struct {
+    BackendStats
+    failures int        // 连续失败的次数
+    openedAt time.Time
+    probing bool        // half-open 状态下已有探测请求
+}
+
+
+type breakers struct {
+    opt *BreakerOption
+    mtx sync.Mutex
+    m map[string]*breaker
+}
+
+
+// 开启熔断，opt 为 nil 时使用 DefaultBreakerOption，需要在发起调用前调用
+func (xc *XClient) SetBreaker(opt *BreakerOption) {
+    if opt == nil {
+        opt = DefaultBreakerOption
+    }
+    xc.breakers = &breakers{opt: opt, m: make(map[string]*breaker)}
+}
+
+
+// 返回所有调用过的实例的统计，按地址排序
+func (xc *XClient) Stats() []BackendStats {
+    b := xc.breakers
+    if b == nil {
+        return nil
+    }
+    b.mtx.Lock()
+    defer b.mtx.Unlock()
+
+    stats := make([]BackendStats, 0, len(b.m))
+    for _, br := range b.m {
+        s := br.BackendStats
+        if b.halfOpen(br) {
+            s.State = CircuitHalfOpen
+        }
+        stats = append(stats, s)
+    }
+    sort.Slice(stats, func(i, j int) bool {
+        return stats[i].Addr < stats[j].Addr
+    })
+    return stats
+}
+
+
+// 熔断器记录的调用结果
+type callResult int
+
+
+const (
+    callSucceeded callResult = iota
+    callFailed
+    callCanceled        // 调用方主动取消，不能说明实例的状态
+)
+
+
+// 调用失败: 连接和网络错误、超时以及实例不可用、过载，其余服务端返回的业务错误视为成功
+func resultOf(ctx context.Context, err error) callResult {
+    if err == nil {
+        return callSucceeded
+    }
+    if ctx.Err() == context.Canceled {
+        return callCanceled
+    }
+    var rpcErr *Error
+    if errors.As(err, &rpcErr) && rpcErr.Code != Unavailable && rpcErr.Code != ResourceExhausted && rpcErr.Code != DeadlineExceeded {
+        return callSucceeded
+    }
+    return callFailed
+}
+
+
+// 打开熔断超过 OpenTimeout 后进入 half-open，需要持有 b.mtx
+func (b *breakers) halfOpen(br *breaker) bool {
+    return br.State == CircuitOpen && time.Since(br.openedAt) >= b.opt.OpenTimeout
+}
+
+
+// 选择实例时是否跳过 rpcAddr，half-open 且已有探测请求时也跳过
+func (b *breakers) open(rpcAddr string) bool {
+    if b == nil {
+        return false
+    }
+    b.mtx.Lock()
+    defer b.mtx.Unlock()
+
+    br := b.m[rpcAddr]
+    if br == nil || br.State == CircuitClosed {
+        return false
+    }
+    return !b.halfOpen(br) || br.probing
+}
+
+
+// 发起调用前调用，half-open 状态下只允许一个探测请求
+func (b *breakers) acquire(rpcAddr string) bool {
+    if b == nil {
+        return true
+    }
+    b.mtx.Lock()
+    defer b.mtx.Unlock()
+
+    br := b.m[rpcAddr]
+    if br == nil || br.State == CircuitClosed {
+        return true
+    }
+    if !b.halfOpen(br) || br.probing {
+        return false
+    }
+    br.probing = true
+    return true
+}
+
+
+// 记录调用结果，返回 true 表示熔断刚刚打开
+func (b *breakers) done(rpcAddr string, latency time.Duration, result callResult) bool {
+    if b == nil {
+        return false
+    }
+    b.mtx.Lock()
+    defer b.mtx.Unlock()
+
+    br := b.m[rpcAddr]
+    if result == callCanceled {
+        // 不记录结果，只释放探测名额，之后的请求可以重新探测
+        if br != nil {
+            br.probing = false
+        }
+        return false
+    }
+    if br == nil {
+        br = &breaker{BackendStats: BackendStats{Addr: rpcAddr}}
+        b.m[rpcAddr] = br
+    }
+    br.Calls++
+    if br.Latency == 0 {
+        br.Latency = latency
+    } else {
+        br.Latency = (br.Latency * 7 + latency) / 8
+    }
+    fail := result == callFailed
+    if b.opt.SlowThreshold > 0 && latency > b.opt.SlowThreshold {
+        fail = true
+    }
+
+    if !fail {
+        br.failures = 0
+        br.State = CircuitClosed
+        br.probing = false
+        return false
+    }
+
+    br.Errors++
+    br.failures++
+    // 探测失败或连续失败次数达到上限时打开熔断
+    if br.probing || (br.State == CircuitClosed && br.failures >= b.opt.MaxFailures) {
+        br.State = CircuitOpen
+        br.openedAt = time.Now()
+        br.probing = false
+        return true
+    }
+    return false
+}
@@ -0,0 +1,102 @@
+package xclient
+
+import (
+    "context"
+    "fmt"
+    "reflect"
+)
+
+
+// 单个实例的调用结果
+type BroadcastResult struct {
+    Reply interface{}       // 和传入的 reply 类型相同，调用失败时为 nil
+    Err error
+}
+
+
+type addrResult struct {
+    addr string
+    result *BroadcastResult
+}
+
+
+// 并发向所有实例发送请求，每个实例使用 reply 类型的新实例，结果通过返回的 chan 依次返回
+func (xc *XClient) broadcastAll(ctx context.Context, servers []string, serviceMethod string, args, reply interface{}) chan *addrResult {
+    results := make(chan *addrResult, len(servers))
+    for _, rpcAddr := range servers {
+        go func(rpcAddr string) {
+            var clonedReply interface{}
+            if reply != nil {
+                clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+            }
+            err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+            if err != nil {
+                clonedReply = nil
+            }
+            results <- &addrResult{addr: rpcAddr, result: &BroadcastResult{Reply: clonedReply, Err: err}}
+        } (rpcAddr)
+    }
+    return results
+}
+
+
+// 向所有实例发送请求并等待全部返回，返回每个实例的结果，reply 只用于确定结果的类型
+// 只有服务发现出错时才返回 error，单个实例的错误在结果中
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}) (map[string]*BroadcastResult, error) {
+    servers, err := xc.getAll(serviceMethod)
+    if err != nil {
+        return nil, err
+    }
+
+    results := xc.broadcastAll(ctx, servers, serviceMethod, args, reply)
+    all := make(map[string]*BroadcastResult, len(servers))
+    for range servers {
+        r := <-results
+        all[r.addr] = r.result
+    }
+    return all, nil
+}
+
+
+// 向所有实例发送请求，n 个实例成功后立即返回，n <= 0 时要求多数实例成功
+// reply 设置为第一个成功的结果，返回时已经收到的结果在 map 中，其余请求继续执行直到 ctx 结束
+// 失败的实例过多，不可能达到 n 个成功时提前返回错误
+func (xc *XClient) Quorum(ctx context.Context, serviceMethod string, args, reply interface{}, n int) (map[string]*BroadcastResult, error) {
+    servers, err := xc.getAll(serviceMethod)
+    if err != nil {
+        return nil, err
+    }
+    if n <= 0 {
+        n = len(servers) / 2 + 1
+    }
+    if n > len(servers) {
+        return nil, fmt.Errorf("rpc xclient: quorum %d is more than %d servers", n, len(servers))
+    }
+
+    results := xc.broadcastAll(ctx, servers, serviceMethod, args, reply)
+    received := make(map[string]*BroadcastResult, len(servers))
+    succeeded, failed := 0, 0
+    var firstErr error
+    for range servers {
+        r := <-results
+        received[r.addr] = r.result
+        if r.result.Err != nil {
+            failed++
+            if firstErr == nil {
+                firstErr = r.result.Err
+            }
+            if failed > len(servers) - n {
+                return received, fmt.Errorf("rpc xclient: quorum not reached, %d of %d servers failed: %w", failed, len(servers), firstErr)
+            }
+            continue
+        }
+
+        if succeeded++; succeeded == 1 && reply != nil {
+            reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(r.result.Reply).Elem())
+        }
+        if succeeded >= n {
+            return received, nil
+        }
+    }
+    return received, firstErr
+}
@@ -1,7 +1,10 @@
 package xclient
 
 import (
+    "context"
+    "encoding/json"
     "errors"
+    "geerpc/registry"
     "math"
     "math/rand"
     "sync"
@@ -18,6 +21,10 @@ type SelectMode int
 const (
     RandomSelect SelectMode = iota
     RoundRobinSelect
+    WeightedRoundRobinSelect    // 按注册中心上报的权重平滑轮询，没有权重时等同于轮询
+    LeastPendingSelect          // 选择未完成请求最少的实例，由 XClient 实现
+    PowerOfTwoSelect            // 随机选两个实例，取未完成请求较少的一个，由 XClient 实现
+    ConsistentHashSelect        // 按 WithHashKey 设置的 key 一致性哈希，由 XClient 实现
 )
 
 
@@ -29,11 +36,20 @@ type Discovery interface {
 }
 
 
+// 可以按服务名筛选实例的服务发现，XClient 会优先使用
+type ServiceDiscovery interface {
+    Discovery
+    GetService(service string, mode SelectMode) (string, error)     // 在提供 service 的实例中选择一个
+    GetAllService(service string) ([]string, error)                 // 返回所有提供 service 的实例
+}
+
+
 type MultiServersDiscovery struct {
     ran *rand.Rand      // 产生随机数的实例
     mtx sync.RWMutex
     servers []string
     index int       // 记录 Round Robin 算法轮询到的位置
+    current map[string]map[string]int   // 平滑加权轮询中每个实例的当前权重，按服务名区分，不同服务筛选出的实例互不影响
 }
 
 
@@ -60,6 +76,7 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
     d.mtx.Lock()
     defer d.mtx.Unlock()
     d.servers = servers
+    d.current = nil
     return nil
 }
 
@@ -67,24 +84,60 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error) {
     d.mtx.Lock()
     defer d.mtx.Unlock()
+    return d.selectServer("", d.servers, nil, mode)
+}
+
 
-    n := len(d.servers)
+// 根据负载均衡策略从提供 service 的 servers 中选择一个，weights 为对应实例的权重，可以为 nil，需要持有 d.mtx
+func (d *MultiServersDiscovery) selectServer(service string, servers []string, weights []int, mode SelectMode) (string, error) {
+    n := len(servers)
     if n == 0 {
         return "", errors.New("rpc discovery: no available servers")
     }
     switch mode {
     case RandomSelect:
-        return d.servers[d.ran.Intn(n)], nil
+        return servers[d.ran.Intn(n)], nil
     case RoundRobinSelect:
-        serv := d.servers[d.index % n]
+        serv := servers[d.index % n]
         d.index = (d.index + 1) % n
         return serv, nil
+    case WeightedRoundRobinSelect:
+        return d.weightedSelect(service, servers, weights), nil
     default:
         return "", errors.New("rpc discovery: not supported select mode")
     }
 }
 
 
+// 平滑加权轮询: 每次所有实例的当前权重加上自身权重，选出最大的一个并减去总权重
+// 权重为 3, 1, 1 时的选择顺序为 a, b, a, c, a，不会连续集中到同一个实例
+func (d *MultiServersDiscovery) weightedSelect(service string, servers []string, weights []int) string {
+    if d.current == nil {
+        d.current = make(map[string]map[string]int)
+    }
+    current := d.current[service]
+    if current == nil {
+        current = make(map[string]int)
+        d.current[service] = current
+    }
+
+    best, total := 0, 0
+    for i, server := range servers {
+        weight := 1
+        if weights != nil && weights[i] > 0 {
+            weight = weights[i]
+        }
+        current[server] += weight
+        total += weight
+        if current[server] > current[servers[best]] {
+            best = i
+        }
+    }
+    current[servers[best]] -= total
+    return servers[best]
+}
+
+
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
     // Lock() 用于获取互斥锁的独占访问权，RLock() 用于获取共享读取访问权
     d.mtx.RLock()
@@ -98,25 +151,49 @@ func (d *MultiServersDiscovery) GetAll() ([]string, error) {
 
 type GeeRegistryDiscovery struct {
     *MultiServersDiscovery
-    registry string
+    registries []string         // 多个注册中心的地址，请求失败时依次切换
+    active int                  // 当前使用的注册中心
     timeout time.Duration
     lastUpdate time.Time
+    items []*registry.ServerItem    // 注册中心返回的实例元数据
+
+    // watch 模式下由后台订阅实例列表的变化，Refresh 不再请求注册中心
+    watching bool
+    index uint64
+    epoch string                // 注册中心的 epoch，和 index 一起发送
+    cancel context.CancelFunc
 }
 
 
+var _ ServiceDiscovery = (*GeeRegistryDiscovery)(nil)
+
+
 const defaultUpdateTimeout = time.Second * 10
 
 
 func NewGeeRegistryDiscovery(registryAddr string, timeout time.Duration) *GeeRegistryDiscovery {
+    d, _ := NewGeeRegistryClusterDiscovery([]string{registryAddr}, timeout)     // 只有一个地址，不会出错
+    return d
+}
+
+
+var errNoRegistry = errors.New("rpc discovery: no registry address")
+
+
+// 使用多个互相同步的注册中心，当前的注册中心不可用时切换到下一个，registryAddrs 为空时返回错误
+func NewGeeRegistryClusterDiscovery(registryAddrs []string, timeout time.Duration) (*GeeRegistryDiscovery, error) {
+    if len(registryAddrs) == 0 {
+        return nil, errNoRegistry
+    }
     if timeout == 0 {
         timeout = defaultUpdateTimeout
     }
     d := &GeeRegistryDiscovery {
         MultiServersDiscovery: NewMultiServersDiscovery(make([]string, 0)),
-        registry: registryAddr,
+        registries: registryAddrs,
         timeout: timeout,
     }
-    return d
+    return d, nil
 }
 
 
@@ -124,49 +201,152 @@ func (d *GeeRegistryDiscovery) Update(servers []string) error {
     d.mtx.Lock()
     defer d.mtx.Unlock()
     d.servers = servers
+    d.items = nil
+    d.current = nil
     d.lastUpdate = time.Now()
     return nil
 }
 
 
 func (d *GeeRegistryDiscovery) Refresh() error {    // 超时重新获取
-    d.mtx.Lock()
-    defer d.mtx.Unlock()
+    if d.watching {
+        return nil
+    }
 
-    if d.lastUpdate.Add(d.timeout).After(time.Now()) {
+    d.mtx.RLock()
+    fresh := d.lastUpdate.Add(d.timeout).After(time.Now())
+    d.mtx.RUnlock()
+    if fresh {
         return nil
     }
     
-    log.Println("rpc registry: refresh servers from registry", d.registry)
-    resp, err := http.Get(d.registry)   // 通过 http 请求服务注册表
-    if err != nil {
+    // 请求注册中心时不持有锁，避免阻塞 Get
+    var err error
+    for i := 0; i < len(d.registries); i++ {
+        registryAddr := d.registry()
+        log.Println("rpc registry: refresh servers from registry", registryAddr)
+        var items []*registry.ServerItem
+        if items, err = fetchServers(registryAddr); err == nil {
+            d.setItems(items)
+            return nil
+        }
         log.Println("rpc registry refresh error:", err)
-        return err
+        d.failover(registryAddr)
     }
+    return err
+}
 
-    servers := strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",")
-    d.servers = make([]string, 0, len(servers))
-    for _, server := range servers {
-        if strings.TrimSpace(server) != "" {
-            d.servers = append(d.servers, strings.TrimSpace(server))
-        }
+
+// 当前使用的注册中心
+func (d *GeeRegistryDiscovery) registry() string {
+    d.mtx.RLock()
+    defer d.mtx.RUnlock()
+    return d.registries[d.active]
+}
+
+
+// registryAddr 请求失败，切换到下一个注册中心，其他请求已经切换过时不再切换
+func (d *GeeRegistryDiscovery) failover(registryAddr string) {
+    d.mtx.Lock()
+    defer d.mtx.Unlock()
+    if d.registries[d.active] == registryAddr {
+        d.active = (d.active + 1) % len(d.registries)
+        d.index, d.epoch = 0, ""     // 不同注册中心的版本号互不相关
+    }
+}
+
+
+func (d *GeeRegistryDiscovery) setItems(items []*registry.ServerItem) {
+    d.mtx.Lock()
+    defer d.mtx.Unlock()
+
+    d.items = items
+    d.current = nil
+    d.servers = make([]string, 0, len(items))
+    for _, item := range items {
+        d.servers = append(d.servers, item.Addr)
     }
     d.lastUpdate = time.Now()
-    return nil
+}
+
+
+func fetchServers(registryAddr string) ([]*registry.ServerItem, error) {
+    httpClient := &http.Client{Timeout: time.Second * 10}
+    resp, err := httpClient.Get(registryAddr)   // 通过 http 请求服务注册表
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, errors.New("rpc registry: refresh error: " + resp.Status)
+    }
+
+    // 优先使用 body 中带元数据的列表，旧版本注册中心只返回 X-Geerpc-Servers
+    var items []*registry.ServerItem
+    if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+        items = nil
+        for _, server := range strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",") {
+            if strings.TrimSpace(server) != "" {
+                items = append(items, &registry.ServerItem{Addr: strings.TrimSpace(server)})
+            }
+        }
+    }
+    return items, nil
 }
 
 
 func (d *GeeRegistryDiscovery) Get(mode SelectMode) (string, error) {
+    return d.GetService("", mode)
+}
+
+
+func (d *GeeRegistryDiscovery) GetAll() ([]string, error) {
+    if err := d.Refresh(); err != nil {
+        return nil, err
+    }
+    return d.MultiServersDiscovery.GetAll()
+}
+
+
+func (d *GeeRegistryDiscovery) GetService(service string, mode SelectMode) (string, error) {
     if err := d.Refresh(); err != nil {
         return "", err
     }
-    return d.MultiServersDiscovery.Get(mode)
+
+    d.mtx.Lock()
+    defer d.mtx.Unlock()
+    servers, weights := d.serviceServers(service)
+    return d.selectServer(service, servers, weights, mode)
 }
 
 
-func (d *GeeRegistryDiscovery) GetAll() ([]string, error) {
+func (d *GeeRegistryDiscovery) GetAllService(service string) ([]string, error) {
     if err := d.Refresh(); err != nil {
         return nil, err
     }
-    return d.MultiServersDiscovery.GetAll()
+
+    d.mtx.RLock()
+    defer d.mtx.RUnlock()
+    servers, _ := d.serviceServers(service)
+    return servers, nil
+}
+
+
+// 筛选提供 service 的实例和对应的权重，手动 Update 的列表没有元数据，全部返回
+func (d *GeeRegistryDiscovery) serviceServers(service string) ([]string, []int) {
+    if d.items == nil {
+        servers := make([]string, len(d.servers))
+        copy(servers, d.servers)
+        return servers, nil
+    }
+
+    servers := make([]string, 0, len(d.items))
+    weights := make([]int, 0, len(d.items))
+    for _, item := range d.items {
+        if item.HasService(service) {
+            servers = append(servers, item.Addr)
+            weights = append(weights, item.Weight)
+        }
+    }
+    return servers, weights
 }
@@ -0,0 +1,188 @@
+package xclient
+
+import (
+    "context"
+    . "geerpc"
+    "reflect"
+    "time"
+)
+
+
+// 调用失败时的处理策略
+type FailMode int
+
+
+const (
+    Failfast FailMode = iota    // 直接返回错误
+    Failover                    // 换一个实例重试
+    Failtry                     // 在同一个实例上重试
+    Hedging                     // 超过 HedgeDelay 未返回时向另一个实例再发一个请求，使用先成功的结果
+)
+
+
+type CallOption struct {
+    FailMode FailMode
+    Retries int                 // Failover 和 Failtry 失败后最多重试的次数，为 0 时使用 defaultRetries
+    HedgeDelay time.Duration    // Hedging 发送第二个请求前等待的时间，为 0 时使用 defaultHedgeDelay
+}
+
+
+const (
+    defaultRetries = 2
+    defaultHedgeDelay = time.Millisecond * 100
+)
+
+
+type callOptionKey struct{}
+
+
+// 为单次调用设置失败处理策略，优先于 XClient 的设置
+func WithCallOption(ctx context.Context, opt *CallOption) context.Context {
+    return context.WithValue(ctx, callOptionKey{}, opt)
+}
+
+
+// 设置 XClient 默认的失败处理策略，需要在发起调用前调用
+func (xc *XClient) SetCallOption(opt *CallOption) {
+    xc.callOpt = opt
+}
+
+
+func (xc *XClient) callOption(ctx context.Context) *CallOption {
+    if opt, ok := ctx.Value(callOptionKey{}).(*CallOption); ok && opt != nil {
+        return opt
+    }
+    if xc.callOpt != nil {
+        return xc.callOpt
+    }
+    return &CallOption{FailMode: Failfast}
+}
+
+
+// 只重试连接和网络错误以及服务端返回的可重试错误，context 结束时不重试，见 geerpc.Retryable
+func retryable(ctx context.Context, err error) bool {
+    return ctx.Err() == nil && Retryable(err)
+}
+
+
+func (opt *CallOption) retries() int {
+    if opt.Retries > 0 {
+        return opt.Retries
+    }
+    return defaultRetries
+}
+
+
+// 换一个实例重试，所有实例都失败后允许重复选择
+func (xc *XClient) failover(ctx context.Context, opt *CallOption, serviceMethod string, args, reply interface{}) error {
+    tried := make(map[string]bool)
+    var err error
+    for i := 0; i <= opt.retries(); i++ {
+        var rpcAddr string
+        if rpcAddr, err = xc.getUntried(ctx, serviceMethod, tried); err != nil {
+            return err
+        }
+        tried[rpcAddr] = true
+        if err = xc.call(rpcAddr, ctx, serviceMethod, args, reply); !retryable(ctx, err) {
+            return err
+        }
+    }
+    return err
+}
+
+
+// 在同一个实例上重试，连接断开时 dial 会重新建立连接
+func (xc *XClient) failtry(ctx context.Context, opt *CallOption, serviceMethod string, args, reply interface{}) error {
+    rpcAddr, err := xc.get(ctx, serviceMethod)
+    if err != nil {
+        return err
+    }
+    for i := 0; i <= opt.retries(); i++ {
+        if err = xc.call(rpcAddr, ctx, serviceMethod, args, reply); !retryable(ctx, err) {
+            return err
+        }
+    }
+    return err
+}
+
+
+type hedgeResult struct {
+    reply interface{}
+    err error
+}
+
+
+// 第一个请求超过 HedgeDelay 未返回或者失败时，向另一个实例发送第二个请求
+// 使用先成功的结果，另一个请求通过 context 取消
+func (xc *XClient) hedge(ctx context.Context, opt *CallOption, serviceMethod string, args, reply interface{}) error {
+    delay := opt.HedgeDelay
+    if delay == 0 {
+        delay = defaultHedgeDelay
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    tried := make(map[string]bool)
+    results := make(chan *hedgeResult, 2)
+    send := func() error {
+        rpcAddr, err := xc.getUntried(ctx, serviceMethod, tried)
+        if err != nil {
+            return err
+        }
+        tried[rpcAddr] = true
+        go func() {
+            var clonedReply interface{}
+            if reply != nil {
+                clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+            }
+            err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+            results <- &hedgeResult{reply: clonedReply, err: err}
+        } ()
+        return nil
+    }
+
+    if err := send(); err != nil {
+        return err
+    }
+    t := time.NewTimer(delay)
+    defer t.Stop()
+
+    inflight, hedged := 1, false
+    var err error
+    for inflight > 0 {
+        select {
+        case <-t.C:
+            if !hedged && send() == nil {
+                inflight++
+            }
+            hedged = true
+        case result := <-results:
+            inflight--
+            if result.err == nil {
+                if reply != nil {
+                    reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(result.reply).Elem())
+                }
+                return nil
+            }
+            err = result.err
+            // 第一个请求在等待时间内失败时立即发送第二个请求
+            if !hedged && retryable(ctx, err) && send() == nil {
+                inflight++
+            }
+            hedged = true
+        }
+    }
+    return err
+}
+
+
+// 选择一个没有尝试过的实例，所有实例都尝试过时允许重复选择
+func (xc *XClient) getUntried(ctx context.Context, serviceMethod string, tried map[string]bool) (string, error) {
+    rpcAddr, err := xc.pick(ctx, serviceMethod, func(rpcAddr string) bool {
+        return tried[rpcAddr] || xc.breakers.open(rpcAddr)
+    })
+    if err == errAllExcluded {
+        return xc.get(ctx, serviceMethod)
+    }
+    return rpcAddr, err
+}
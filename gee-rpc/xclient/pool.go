@@ -0,0 +1,234 @@
+package xclient
+
+import (
+    "context"
+    "errors"
+    . "geerpc"
+    "sync"
+    "time"
+)
+
+/*
+每个地址一个连接池，Client 支持多路复用，连接不会被独占:
+优先使用没有未完成请求的连接，所有连接都在使用且未达到 MaxSize 时建立新连接，
+否则使用未完成请求最少的连接。建立连接时不持有任何锁，不会阻塞其他地址的调用。
+*/
+
+
+type PoolOption struct {
+    MaxSize int                     // 每个地址最多的连接数
+    IdleTimeout time.Duration       // 空闲超过该时间的连接会被关闭，为 0 时不关闭
+    CheckInterval time.Duration     // 后台检查连接的周期，关闭断开和空闲的连接，为 0 时不检查
+}
+
+
+var DefaultPoolOption = &PoolOption {
+    MaxSize: 1,
+}
+
+
+// 连接池已被 checkPools、evict 或 Close 关闭，调用方应重新查找连接池
+var errPoolClosed = errors.New("rpc client: connection pool is closed")
+
+
+type pooledClient struct {
+    *Client
+    lastUsed time.Time
+}
+
+
+type pool struct {
+    opt *PoolOption
+    mtx sync.Mutex
+    clients []*pooledClient
+    dialing int                 // 正在建立的连接数
+    dialDone chan struct{}      // 有连接建立完成时关闭
+    closed bool
+}
+
+
+func newPool(opt *PoolOption) *pool {
+    return &pool {
+        opt: opt,
+        dialDone: make(chan struct{}),
+    }
+}
+
+
+// 设置连接池，opt 为 nil 时使用 DefaultPoolOption，需要在发起调用前调用
+func (xc *XClient) SetPool(opt *PoolOption) {
+    if opt == nil {
+        opt = DefaultPoolOption
+    }
+    poolOpt := *opt
+    if poolOpt.MaxSize <= 0 {
+        poolOpt.MaxSize = 1
+    }
+
+    xc.mtx.Lock()
+    defer xc.mtx.Unlock()
+    xc.poolOpt = &poolOpt
+    if opt.CheckInterval > 0 && xc.done == nil {
+        xc.done = make(chan struct{})
+        go xc.checkPools(opt.CheckInterval, xc.done)
+    }
+}
+
+
+// 定期检查所有连接池，删除没有连接的连接池
+func (xc *XClient) checkPools(interval time.Duration, done chan struct{}) {
+    t := time.NewTicker(interval)
+    defer t.Stop()
+    for {
+        select {
+        case <-t.C:
+        case <-done:
+            return
+        }
+
+        xc.mtx.Lock()
+        pools := make(map[string]*pool, len(xc.pools))
+        for addr, p := range xc.pools {
+            pools[addr] = p
+        }
+        xc.mtx.Unlock()
+
+        for addr, p := range pools {
+            if p.check() == 0 {
+                xc.mtx.Lock()
+                if xc.pools[addr] == p && p.size() == 0 {
+                    delete(xc.pools, addr)
+                    p.close()
+                }
+                xc.mtx.Unlock()
+            }
+        }
+    }
+}
+
+
+// 从连接池中取一个连接，需要时通过 dial 建立新连接，等待其他连接建立时 ctx 结束则返回 ctx 的错误
+func (p *pool) get(ctx context.Context, dial func() (*Client, error)) (*Client, error) {
+    for {
+        p.mtx.Lock()
+        if p.closed {
+            p.mtx.Unlock()
+            return nil, errPoolClosed
+        }
+        p.removeUnavailable()
+
+        var best *pooledClient
+        bestPending := 0
+        for _, c := range p.clients {
+            if n := c.NumPending(); best == nil || n < bestPending {
+                best, bestPending = c, n
+            }
+        }
+        if best != nil && (bestPending == 0 || len(p.clients) + p.dialing >= p.opt.MaxSize) {
+            best.lastUsed = time.Now()
+            p.mtx.Unlock()
+            return best.Client, nil
+        }
+        if best == nil && p.dialing >= p.opt.MaxSize {
+            // 连接都在建立中，等待其中一个完成
+            wait := p.dialDone
+            p.mtx.Unlock()
+            select {
+            case <-wait:
+            case <-ctx.Done():
+                return nil, ctx.Err()
+            }
+            continue
+        }
+        p.dialing++
+        p.mtx.Unlock()
+
+        client, err := dial()
+
+        p.mtx.Lock()
+        p.dialing--
+        close(p.dialDone)
+        p.dialDone = make(chan struct{})
+        if err == nil {
+            if p.closed {
+                _ = client.Close()
+                err = errPoolClosed
+            } else {
+                p.clients = append(p.clients, &pooledClient{Client: client, lastUsed: time.Now()})
+            }
+        }
+        p.mtx.Unlock()
+
+        if err != nil && err != errPoolClosed && best != nil {
+            return best.Client, nil     // 建立新连接失败时继续使用已有的连接
+        }
+        return client, err
+    }
+}
+
+
+// 删除已经断开的连接，需要持有 p.mtx
+func (p *pool) removeUnavailable() {
+    clients := p.clients[:0]
+    for _, c := range p.clients {
+        if c.IsAvailable() {
+            clients = append(clients, c)
+        } else {
+            _ = c.Close()
+        }
+    }
+    p.clients = clients
+}
+
+
+// 关闭断开和空闲超时的连接，返回剩余的连接数
+func (p *pool) check() int {
+    p.mtx.Lock()
+    defer p.mtx.Unlock()
+
+    p.removeUnavailable()
+    if p.opt.IdleTimeout > 0 {
+        clients := p.clients[:0]
+        for _, c := range p.clients {
+            if c.NumPending() == 0 && time.Since(c.lastUsed) > p.opt.IdleTimeout {
+                _ = c.Close()
+            } else {
+                clients = append(clients, c)
+            }
+        }
+        p.clients = clients
+    }
+    return len(p.clients) + p.dialing
+}
+
+
+func (p *pool) size() int {
+    p.mtx.Lock()
+    defer p.mtx.Unlock()
+    return len(p.clients) + p.dialing
+}
+
+
+// 所有连接上未完成的请求数
+func (p *pool) pending() int {
+    p.mtx.Lock()
+    defer p.mtx.Unlock()
+
+    n := 0
+    for _, c := range p.clients {
+        n += c.NumPending()
+    }
+    return n
+}
+
+
+func (p *pool) close() {
+    p.mtx.Lock()
+    defer p.mtx.Unlock()
+
+    p.closed = true
+    for _, c := range p.clients {
+        _ = c.Close()
+    }
+    p.clients = nil
+}
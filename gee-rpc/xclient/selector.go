@@ -0,0 +1,162 @@
+package xclient
+
+import (
+    "context"
+    "errors"
+    "hash/crc32"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+
+// 需要调用时信息的负载均衡策略，由 XClient 在服务发现返回的实例中选择一个
+type Selector interface {
+    Select(ctx context.Context, servers []string) (string, error)
+}
+
+
+var errNoServers = errors.New("rpc discovery: no available servers")
+
+
+type hashKey struct{}
+
+
+// 设置一致性哈希使用的 key，相同 key 的请求会发送到同一个实例
+func WithHashKey(ctx context.Context, key string) context.Context {
+    return context.WithValue(ctx, hashKey{}, key)
+}
+
+
+func hashKeyFromContext(ctx context.Context) (string, bool) {
+    key, ok := ctx.Value(hashKey{}).(string)
+    return key, ok
+}
+
+
+// 选择未完成请求最少的实例，pending 返回实例上未完成的请求数
+type leastPendingSelector struct {
+    pending func(rpcAddr string) int
+}
+
+
+func (s *leastPendingSelector) Select(ctx context.Context, servers []string) (string, error) {
+    if len(servers) == 0 {
+        return "", errNoServers
+    }
+    best, min := servers[0], s.pending(servers[0])
+    for _, server := range servers[1:] {
+        if n := s.pending(server); n < min {
+            best, min = server, n
+        }
+    }
+    return best, nil
+}
+
+
+// 随机选择两个实例，取未完成请求较少的一个，避免所有请求同时涌向同一个最空闲的实例
+type powerOfTwoSelector struct {
+    pending func(rpcAddr string) int
+    mtx sync.Mutex
+    ran *rand.Rand
+}
+
+
+func (s *powerOfTwoSelector) Select(ctx context.Context, servers []string) (string, error) {
+    n := len(servers)
+    if n == 0 {
+        return "", errNoServers
+    }
+    if n == 1 {
+        return servers[0], nil
+    }
+
+    s.mtx.Lock()
+    i := s.ran.Intn(n)
+    j := s.ran.Intn(n - 1)
+    s.mtx.Unlock()
+    if j >= i {
+        j++
+    }
+    if s.pending(servers[j]) < s.pending(servers[i]) {
+        return servers[j], nil
+    }
+    return servers[i], nil
+}
+
+
+const defaultReplicas = 50     // 每个实例在哈希环上的虚拟节点数
+
+
+// 一致性哈希，实例列表变化时只有少量 key 会换到其他实例
+type hashSelector struct {
+    mtx sync.Mutex
+    members string      // 当前哈希环对应的实例列表，变化时重建
+    keys []uint32       // 排序后的虚拟节点
+    nodes map[uint32]string
+}
+
+
+func (s *hashSelector) Select(ctx context.Context, servers []string) (string, error) {
+    if len(servers) == 0 {
+        return "", errNoServers
+    }
+    key, ok := hashKeyFromContext(ctx)
+    if !ok {
+        return "", errors.New("rpc discovery: consistent hash requires a key, use WithHashKey")
+    }
+
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.build(servers)
+
+    hash := crc32.ChecksumIEEE([]byte(key))
+    idx := sort.Search(len(s.keys), func(i int) bool {
+        return s.keys[i] >= hash
+    })
+    return s.nodes[s.keys[idx % len(s.keys)]], nil
+}
+
+
+// 实例列表变化时重建哈希环，需要持有 s.mtx
+func (s *hashSelector) build(servers []string) {
+    sorted := make([]string, len(servers))
+    copy(sorted, servers)
+    sort.Strings(sorted)
+    members := strings.Join(sorted, ",")
+    if members == s.members {
+        return
+    }
+
+    s.members = members
+    s.keys = make([]uint32, 0, len(sorted) * defaultReplicas)
+    s.nodes = make(map[uint32]string, len(sorted) * defaultReplicas)
+    for _, server := range sorted {
+        for i := 0; i < defaultReplicas; i++ {
+            hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + server))
+            s.keys = append(s.keys, hash)
+            s.nodes[hash] = server
+        }
+    }
+    sort.Slice(s.keys, func(i, j int) bool {
+        return s.keys[i] < s.keys[j]
+    })
+}
+
+
+// 根据 mode 创建 XClient 使用的 Selector，由服务发现实现的策略返回 nil
+func newSelector(mode SelectMode, pending func(string) int) Selector {
+    switch mode {
+    case LeastPendingSelect:
+        return &leastPendingSelector{pending: pending}
+    case PowerOfTwoSelect:
+        return &powerOfTwoSelector{pending: pending, ran: rand.New(rand.NewSource(time.Now().UnixNano()))}
+    case ConsistentHashSelect:
+        return &hashSelector{}
+    default:
+        return nil
+    }
+}
@@ -0,0 +1,132 @@
+package xclient
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "geerpc/registry"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+
+const (
+    watchHTTPTimeout = time.Minute * 2     // 需要大于注册中心长轮询的等待时间
+    maxWatchBackoff = time.Second * 30
+)
+
+
+// 通过注册中心的 watch 接口订阅实例列表的变化，后台异步更新，Get 不会再阻塞在网络请求上
+// 传入多个注册中心时，当前的注册中心不可用会切换到下一个，使用完毕后需要调用 Close 停止订阅
+func NewGeeRegistryWatchDiscovery(registryAddrs ...string) (*GeeRegistryDiscovery, error) {
+    d, err := NewGeeRegistryClusterDiscovery(registryAddrs, 0)
+    if err != nil {
+        return nil, err
+    }
+    d.watching = true
+
+    var ctx context.Context
+    ctx, d.cancel = context.WithCancel(context.Background())
+    // 第一次 watch 会立即返回当前的实例列表
+    for range d.registries {
+        registryAddr := d.registry()
+        err := d.watchOnce(ctx, registryAddr)
+        if err == nil {
+            break
+        }
+        log.Println("rpc registry watch error:", err)
+        d.failover(registryAddr)
+    }
+    go d.watchLoop(ctx)
+    return d, nil
+}
+
+
+func (d *GeeRegistryDiscovery) Close() error {
+    if d.cancel != nil {
+        d.cancel()
+    }
+    return nil
+}
+
+
+func (d *GeeRegistryDiscovery) watchLoop(ctx context.Context) {
+    var failures int
+    var backoff time.Duration
+    for ctx.Err() == nil {
+        registryAddr := d.registry()
+        err := d.watchOnce(ctx, registryAddr)
+        if err == nil {
+            failures, backoff = 0, 0
+            continue
+        }
+        if ctx.Err() != nil {
+            return
+        }
+        log.Println("rpc registry watch error:", err)
+        d.failover(registryAddr)
+
+        // 先依次尝试其他注册中心，都不可用时按指数退避重试，期间保留原来的实例列表
+        if failures++; failures < len(d.registries) {
+            continue
+        }
+        if backoff == 0 {
+            backoff = time.Second
+        } else if backoff *= 2; backoff > maxWatchBackoff {
+            backoff = maxWatchBackoff
+        }
+        select {
+        case <-time.After(backoff):
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+
+func (d *GeeRegistryDiscovery) watchOnce(ctx context.Context, registryAddr string) error {
+    u, err := url.Parse(registryAddr)
+    if err != nil {
+        return err
+    }
+    d.mtx.RLock()
+    index, epoch := d.index, d.epoch
+    d.mtx.RUnlock()
+
+    query := u.Query()
+    query.Set("watch", "1")
+    query.Set("index", strconv.FormatUint(index, 10))
+    if epoch != "" {
+        query.Set("epoch", epoch)
+    }
+    u.RawQuery = query.Encode()
+
+    req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+    httpClient := &http.Client{Timeout: watchHTTPTimeout}
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return errors.New("rpc registry watch error: " + resp.Status)
+    }
+
+    var result registry.WatchResult
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return err
+    }
+
+    // 注册中心重启后版本号从头计数，返回的是完整的实例列表，直接以新的版本号重新同步
+    if (epoch != "" && result.Epoch != epoch) || result.Index < index {
+        log.Println("rpc registry: registry", registryAddr, "restarted, resync servers")
+    }
+    d.setItems(result.Servers)
+    d.mtx.Lock()
+    d.index, d.epoch = result.Index, result.Epoch
+    d.mtx.Unlock()
+    return nil
+}
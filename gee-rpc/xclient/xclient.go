@@ -2,19 +2,29 @@ package xclient
 
 import (
     "context"
+    "errors"
     . "geerpc"
     "io"
+    "math/rand"
     "reflect"
+    "strings"
     "sync"
+    "time"
 )
 
 
 type XClient struct {
     d Discovery
     mode SelectMode
+    selector Selector       // 不为 nil 时由 XClient 选择实例，否则由服务发现按 mode 选择
     opt *Option
+    callOpt *CallOption     // 失败处理策略，为 nil 时直接返回错误
+    breakers *breakers      // 按实例统计调用结果并熔断，为 nil 时不熔断
     mtx sync.Mutex
-    clients map[string]*Client
+    pools map[string]*pool      // 每个地址的连接池
+    poolOpt *PoolOption
+    done chan struct{}          // 关闭时停止后台检查连接池
+    interceptors []ClientInterceptor
 }
 
 
@@ -22,12 +32,42 @@ var _ io.Closer = (*XClient)(nil)
 
 
 func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-    return &XClient{
+    xc := &XClient{
         d: d,
         mode: mode,
         opt: opt,
-        clients: make(map[string]*Client),
+        pools: make(map[string]*pool),
+        poolOpt: DefaultPoolOption,
     }
+    xc.selector = newSelector(mode, xc.pending)
+    return xc
+}
+
+
+// 使用自定义的负载均衡策略，在服务发现返回的所有实例中选择，需要在发起调用前调用
+func (xc *XClient) SetSelector(selector Selector) {
+    xc.selector = selector
+}
+
+
+// 实例上未完成的请求数，没有建立连接时为 0
+func (xc *XClient) pending(rpcAddr string) int {
+    xc.mtx.Lock()
+    p := xc.pools[rpcAddr]
+    xc.mtx.Unlock()
+
+    if p == nil {
+        return 0
+    }
+    return p.pending()
+}
+
+
+// 添加客户端拦截器，作用于之后建立的所有连接
+func (xc *XClient) Use(interceptors ...ClientInterceptor) {
+    xc.mtx.Lock()
+    defer xc.mtx.Unlock()
+    xc.interceptors = append(xc.interceptors, interceptors...)
 }
 
 
@@ -35,51 +75,160 @@ func (xc *XClient) Close() error {
     xc.mtx.Lock()
     defer xc.mtx.Unlock()
 
-    for key, client := range xc.clients {
-        _ = client.Close()
-        delete(xc.clients, key)
+    for addr, p := range xc.pools {
+        p.close()
+        delete(xc.pools, addr)
+    }
+    if xc.done != nil {
+        close(xc.done)
+        xc.done = nil
     }
     return nil
 }
 
 
-func (xc *XClient) dial(rpcAddr string) (*Client, error) {
-    // 检查 xc.clients 是否有缓存的 Client, 如果有，检查是否是可用状态，如果不可用，如果是则返回缓存中的 Client，否则从缓存中删除
-    // 如果没有返回缓存中的 Client，则创建新的 Client
+func (xc *XClient) dial(ctx context.Context, rpcAddr string) (*Client, error) {
+    for {
+        // 只在查找连接池时持有 xc.mtx，建立连接由连接池在锁外完成
+        xc.mtx.Lock()
+        p, ok := xc.pools[rpcAddr]
+        if !ok {
+            p = newPool(xc.poolOpt)
+            xc.pools[rpcAddr] = p
+        }
+        interceptors := xc.interceptors
+        xc.mtx.Unlock()
+
+        client, err := p.get(ctx, func() (*Client, error) {
+            client, err := XDial(rpcAddr, xc.opt)
+            if err != nil {
+                return nil, err
+            }
+            client.Use(interceptors...)
+            return client, nil
+        })
+        // 查找到的连接池在使用前被关闭并删除，重新查找或建立连接池
+        if err == errPoolClosed {
+            continue
+        }
+        return client, err
+    }
+}
+
+
+func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+    if !xc.breakers.acquire(rpcAddr) {
+        return ErrCircuitOpen
+    }
+    start := time.Now()
+    client, err := xc.dial(ctx, rpcAddr)
+    if err == nil {
+        err = client.Call(ctx, serviceMethod, args, reply)
+    }
+    if xc.breakers.done(rpcAddr, time.Since(start), resultOf(ctx, err)) {
+        xc.evict(rpcAddr)
+    }
+    return err
+}
+
+
+// 关闭并删除地址的连接池，熔断恢复后重新建立连接
+func (xc *XClient) evict(rpcAddr string) {
     xc.mtx.Lock()
     defer xc.mtx.Unlock()
 
-    client, ok := xc.clients[rpcAddr]
-    if ok && !client.IsAvailable() {
-        _ = client.Close()
-        delete(xc.clients, rpcAddr)
-        client = nil
+    if p, ok := xc.pools[rpcAddr]; ok {
+        p.close()
+        delete(xc.pools, rpcAddr)
+    }
+}
+
+
+// 选择一个实例，跳过熔断中的实例
+func (xc *XClient) get(ctx context.Context, serviceMethod string) (string, error) {
+    rpcAddr, err := xc.pick(ctx, serviceMethod, xc.breakers.open)
+    if err == errAllExcluded {
+        err = ErrCircuitOpen
     }
+    return rpcAddr, err
+}
+
+
+var errAllExcluded = errors.New("rpc xclient: all servers are excluded")
 
-    if client == nil {
-        var err error
-        client, err = XDial(rpcAddr, xc.opt)
-        if err != nil {
-            return nil, err
+
+// 按负载均衡策略选择一个实例，跳过 exclude 返回 true 的实例，所有实例都被跳过时返回 errAllExcluded
+func (xc *XClient) pick(ctx context.Context, serviceMethod string, exclude func(string) bool) (string, error) {
+    if xc.selector == nil {
+        rpcAddr, err := xc.getByMode(serviceMethod)
+        if err != nil || !exclude(rpcAddr) {
+            return rpcAddr, err
         }
-        xc.clients[rpcAddr] = client
     }
 
-    return client, nil
+    servers, err := xc.getAll(serviceMethod)
+    if err != nil {
+        return "", err
+    }
+    if len(servers) == 0 {
+        return "", errNoServers
+    }
+    candidates := make([]string, 0, len(servers))
+    for _, server := range servers {
+        if !exclude(server) {
+            candidates = append(candidates, server)
+        }
+    }
+    if len(candidates) == 0 {
+        return "", errAllExcluded
+    }
+    if xc.selector != nil {
+        return xc.selector.Select(ctx, candidates)
+    }
+    // 按 mode 选择到被跳过的实例时，从剩余的实例中随机选择
+    return candidates[rand.Intn(len(candidates))], nil
 }
 
 
-func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
-    client, err := xc.dial(rpcAddr)
-    if err != nil {
-        return err
+// 服务发现支持按服务名筛选时，只选择提供该服务的实例
+func (xc *XClient) getByMode(serviceMethod string) (string, error) {
+    if d, ok := xc.d.(ServiceDiscovery); ok {
+        return d.GetService(serviceName(serviceMethod), xc.mode)
+    }
+    return xc.d.Get(xc.mode)
+}
+
+
+func (xc *XClient) getAll(serviceMethod string) ([]string, error) {
+    if d, ok := xc.d.(ServiceDiscovery); ok {
+        return d.GetAllService(serviceName(serviceMethod))
     }
-    return client.Call(ctx, serviceMethod, args, reply)
+    return xc.d.GetAll()
 }
 
 
+// Service.Method => Service
+func serviceName(serviceMethod string) string {
+    if dotIdx := strings.LastIndex(serviceMethod, "."); dotIdx >= 0 {
+        return serviceMethod[:dotIdx]
+    }
+    return serviceMethod
+}
+
+
+// 按 WithCallOption 或 SetCallOption 设置的策略处理失败，默认直接返回错误
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-    rpcAddr, err := xc.d.Get(xc.mode)
+    opt := xc.callOption(ctx)
+    switch opt.FailMode {
+    case Failover:
+        return xc.failover(ctx, opt, serviceMethod, args, reply)
+    case Failtry:
+        return xc.failtry(ctx, opt, serviceMethod, args, reply)
+    case Hedging:
+        return xc.hedge(ctx, opt, serviceMethod, args, reply)
+    }
+
+    rpcAddr, err := xc.get(ctx, serviceMethod)
     if err != nil {
         return err
     }
@@ -88,7 +237,7 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply i
 
 
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-    servers, err := xc.d.GetAll()
+    servers, err := xc.getAll(serviceMethod)
     if err != nil {
         return err
     }
@@ -99,6 +248,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 
     replyDone := reply == nil
     ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
     for _, rpcAddr := range servers {
         wg.Add(1)
         go func(rpcAddr string) {
@@ -0,0 +1,573 @@
+package xclient
+
+import (
+    "context"
+    "errors"
+    "geerpc"
+    "geerpc/registry"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+
+func TestServiceDiscovery(test *testing.T) {
+    r := registry.NewGeeRegistry(time.Minute)
+    ts := httptest.NewServer(r)
+    defer ts.Close()
+
+    registry.HeartbeatServer(ts.URL, &registry.ServerItem{Addr: "tcp@127.0.0.1:1001", Services: []string{"Foo"}}, time.Minute)
+    registry.HeartbeatServer(ts.URL, &registry.ServerItem{Addr: "tcp@127.0.0.1:1002", Services: []string{"Foo", "Bar"}}, time.Minute)
+
+    d := NewGeeRegistryDiscovery(ts.URL, 0)
+    servers, err := d.GetAllService("Bar")
+    if err != nil || len(servers) != 1 || servers[0] != "tcp@127.0.0.1:1002" {
+        test.Fatalf("unexpected servers %v, error %v", servers, err)
+    }
+    for i := 0; i < 4; i++ {
+        if server, err := d.GetService("Bar", RoundRobinSelect); err != nil || server != "tcp@127.0.0.1:1002" {
+            test.Fatalf("unexpected server %s, error %v", server, err)
+        }
+    }
+    if _, err := d.GetService("Baz", RandomSelect); err == nil {
+        test.Fatal("no server provides Baz")
+    }
+
+    servers, _ = d.GetAll()
+    if len(servers) != 2 {
+        test.Fatal("expect 2 servers, got", servers)
+    }
+}
+
+
+func TestWatchDiscovery(test *testing.T) {
+    r := registry.NewGeeRegistry(time.Minute)
+    ts := httptest.NewServer(r)
+    defer ts.Close()
+
+    registry.HeartbeatServer(ts.URL, &registry.ServerItem{Addr: "tcp@127.0.0.1:1001"}, time.Minute)
+    if _, err := NewGeeRegistryWatchDiscovery(); err == nil {
+        test.Fatal("expect error without registry address")
+    }
+    d, err := NewGeeRegistryWatchDiscovery(ts.URL)
+    if err != nil {
+        test.Fatal("watch discovery error:", err)
+    }
+    defer d.Close()
+    if servers, err := d.GetAll(); err != nil || len(servers) != 1 {
+        test.Fatalf("unexpected servers %v, error %v", servers, err)
+    }
+
+    // 实例列表的变化由后台的 watch 异步更新
+    waitServers := func(n int) {
+        for i := 0; i < 20; i++ {
+            if servers, _ := d.GetAll(); len(servers) == n {
+                return
+            }
+            time.Sleep(time.Millisecond * 10)
+        }
+        servers, _ := d.GetAll()
+        test.Fatalf("expect %d servers, got %v", n, servers)
+    }
+    registry.HeartbeatServer(ts.URL, &registry.ServerItem{Addr: "tcp@127.0.0.1:1002"}, time.Minute)
+    waitServers(2)
+    if err := registry.Deregister(ts.URL, "tcp@127.0.0.1:1001"); err != nil {
+        test.Fatal("deregister error:", err)
+    }
+    waitServers(1)
+
+    // 注册中心重启后 epoch 不同，版本号碰巧相同也立即返回新的实例列表
+    restarted := NewGeeRegistryDiscovery(ts.URL, 0)
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second * 2)
+    defer cancel()
+    if err := restarted.watchOnce(ctx, ts.URL); err != nil {
+        test.Fatal("watch error:", err)
+    }
+    restarted.epoch = "stale"
+    if err := restarted.watchOnce(ctx, ts.URL); err != nil {
+        test.Fatal("watch with a stale epoch should return immediately, got", err)
+    }
+    if servers, _ := restarted.GetAll(); len(servers) != 1 {
+        test.Fatal("expect 1 server, got", servers)
+    }
+}
+
+
+func TestRegistryFailover(test *testing.T) {
+    r := registry.NewGeeRegistry(time.Minute)
+    ts := httptest.NewServer(r)
+    defer ts.Close()
+    down := httptest.NewServer(http.NotFoundHandler())
+    down.Close()
+
+    registry.HeartbeatServer(ts.URL, &registry.ServerItem{Addr: "tcp@127.0.0.1:1001"}, time.Minute)
+
+    if _, err := NewGeeRegistryClusterDiscovery(nil, 0); err == nil {
+        test.Fatal("an empty registry list should be rejected")
+    }
+    d, err := NewGeeRegistryClusterDiscovery([]string{down.URL, ts.URL}, 0)
+    if err != nil {
+        test.Fatal("cluster discovery error:", err)
+    }
+    if servers, err := d.GetAll(); err != nil || len(servers) != 1 {
+        test.Fatalf("unexpected servers %v, error %v", servers, err)
+    }
+
+    w, err := NewGeeRegistryWatchDiscovery(down.URL, ts.URL)
+    if err != nil {
+        test.Fatal("watch discovery error:", err)
+    }
+    defer w.Close()
+    if servers, err := w.GetAll(); err != nil || len(servers) != 1 {
+        test.Fatalf("unexpected servers %v, error %v", servers, err)
+    }
+}
+
+
+func TestSelectModes(test *testing.T) {
+    r := registry.NewGeeRegistry(time.Minute)
+    ts := httptest.NewServer(r)
+    defer ts.Close()
+    registry.HeartbeatServer(ts.URL, &registry.ServerItem{Addr: "tcp@127.0.0.1:1001", Weight: 3}, time.Minute)
+    registry.HeartbeatServer(ts.URL, &registry.ServerItem{Addr: "tcp@127.0.0.1:1002"}, time.Minute)
+
+    d := NewGeeRegistryDiscovery(ts.URL, 0)
+    counts := make(map[string]int)
+    for i := 0; i < 8; i++ {
+        server, err := d.Get(WeightedRoundRobinSelect)
+        if err != nil {
+            test.Fatal("get error:", err)
+        }
+        counts[server]++
+    }
+    if counts["tcp@127.0.0.1:1001"] != 6 || counts["tcp@127.0.0.1:1002"] != 2 {
+        test.Fatal("unexpected weighted distribution:", counts)
+    }
+
+    // 不同服务筛选出的实例交替选择，各自的选择顺序不受影响
+    var seq string
+    for i := 0; i < 8; i++ {
+        server, _ := d.selectServer("Foo", []string{"a", "b"}, []int{3, 1}, WeightedRoundRobinSelect)
+        seq += server
+        _, _ = d.selectServer("Bar", []string{"a", "c"}, []int{2, 9}, WeightedRoundRobinSelect)
+    }
+    if seq != "aabaaaba" {
+        test.Fatal("unexpected weighted order with interleaved services:", seq)
+    }
+
+    servers := []string{"tcp@127.0.0.1:1001", "tcp@127.0.0.1:1002", "tcp@127.0.0.1:1003"}
+    pending := map[string]int{servers[0]: 5, servers[1]: 1, servers[2]: 3}
+    ctx := context.Background()
+    if server, _ := newSelector(LeastPendingSelect, func(addr string) int { return pending[addr] }).Select(ctx, servers); server != servers[1] {
+        test.Fatal("expect the least pending server, got", server)
+    }
+    p2c := newSelector(PowerOfTwoSelect, func(addr string) int { return pending[addr] })
+    for i := 0; i < 20; i++ {
+        if server, _ := p2c.Select(ctx, servers); server == servers[0] {
+            test.Fatal("the busiest server should never win a power of two choice")
+        }
+    }
+
+    // 相同 key 总是选择同一个实例，移除一个实例只影响原来在该实例上的 key
+    hash := newSelector(ConsistentHashSelect, nil)
+    if _, err := hash.Select(ctx, servers); err == nil {
+        test.Fatal("consistent hash without a key should fail")
+    }
+    before := make(map[string]string)
+    for i := 0; i < 100; i++ {
+        key := strconv.Itoa(i)
+        server, _ := hash.Select(WithHashKey(ctx, key), servers)
+        if again, _ := hash.Select(WithHashKey(ctx, key), servers); again != server {
+            test.Fatalf("key %s moved from %s to %s", key, server, again)
+        }
+        before[key] = server
+    }
+    for key, server := range before {
+        after, _ := hash.Select(WithHashKey(ctx, key), servers[:2])
+        if server != servers[2] && after != server {
+            test.Fatalf("key %s moved from %s to %s", key, server, after)
+        }
+    }
+}
+
+
+type Foo struct {
+    delay time.Duration
+    calls int32
+}
+
+type Args struct {
+    Num1 int
+    Num2 int
+}
+
+
+func (foo *Foo) Sum(args Args, reply *int) error {
+    atomic.AddInt32(&foo.calls, 1)
+    time.Sleep(foo.delay)
+    *reply = args.Num1 + args.Num2
+    return nil
+}
+
+
+func (foo *Foo) Fail(args Args, reply *int) error {
+    atomic.AddInt32(&foo.calls, 1)
+    return errors.New("always fail")
+}
+
+
+// 返回可重试的错误
+func (foo *Foo) Busy(args Args, reply *int) error {
+    atomic.AddInt32(&foo.calls, 1)
+    return geerpc.NewError(geerpc.Unavailable, "busy")
+}
+
+
+func startServer(test *testing.T, foo *Foo) string {
+    server := geerpc.NewServer()
+    if err := server.Register(foo); err != nil {
+        test.Fatal("register error:", err)
+    }
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        test.Fatal("network error:", err)
+    }
+    test.Cleanup(func() {
+        _ = listener.Close()
+    })
+    go server.Accept(listener)
+    return "tcp@" + listener.Addr().String()
+}
+
+
+// 返回一个没有服务监听的地址
+func deadServer(test *testing.T) string {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        test.Fatal("network error:", err)
+    }
+    _ = listener.Close()
+    return "tcp@" + listener.Addr().String()
+}
+
+
+func TestFailModes(test *testing.T) {
+    foo := &Foo{}
+    good, dead := startServer(test, foo), deadServer(test)
+    xc := NewXClient(NewMultiServersDiscovery([]string{dead, good}), RoundRobinSelect, nil)
+    defer xc.Close()
+
+    var reply int
+    failed := 0
+    for i := 0; i < 4; i++ {
+        if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil {
+            failed++
+        }
+    }
+    if failed != 2 {
+        test.Fatal("failfast should fail on the dead server, failed", failed)
+    }
+
+    xc.SetCallOption(&CallOption{FailMode: Failover})
+    for i := 0; i < 4; i++ {
+        if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 2}, &reply); err != nil || reply != i + 2 {
+            test.Fatalf("expect %d, got %d, error %v", i + 2, reply, err)
+        }
+    }
+
+    // 服务端返回的错误不重试
+    atomic.StoreInt32(&foo.calls, 0)
+    for _, mode := range []FailMode{Failover, Failtry} {
+        xc := NewXClient(NewMultiServersDiscovery([]string{good}), RandomSelect, nil)
+        ctx := WithCallOption(context.Background(), &CallOption{FailMode: mode, Retries: 3})
+        if err := xc.Call(ctx, "Foo.Fail", &Args{}, &reply); err == nil || !strings.Contains(err.Error(), "always fail") {
+            test.Fatal("expect server error, got", err)
+        }
+        _ = xc.Close()
+    }
+    if n := atomic.LoadInt32(&foo.calls); n != 2 {
+        test.Fatal("server error should not be retried, got", n, "calls")
+    }
+
+    // 服务端返回的 Unavailable 可以重试
+    atomic.StoreInt32(&foo.calls, 0)
+    xcBusy := NewXClient(NewMultiServersDiscovery([]string{good}), RandomSelect, nil)
+    ctx := WithCallOption(context.Background(), &CallOption{FailMode: Failtry, Retries: 2})
+    if err := xcBusy.Call(ctx, "Foo.Busy", &Args{}, &reply); !errors.Is(err, geerpc.Unavailable) {
+        test.Fatal("expect unavailable error, got", err)
+    }
+    _ = xcBusy.Close()
+    if n := atomic.LoadInt32(&foo.calls); n != 3 {
+        test.Fatal("unavailable error should be retried, got", n, "calls")
+    }
+
+    xc = NewXClient(NewMultiServersDiscovery([]string{dead}), RandomSelect, nil)
+    defer xc.Close()
+    ctx = WithCallOption(context.Background(), &CallOption{FailMode: Failtry})
+    if err := xc.Call(ctx, "Foo.Sum", &Args{}, &reply); err == nil {
+        test.Fatal("call to a dead server should fail after retries")
+    }
+}
+
+
+func TestHedging(test *testing.T) {
+    slow, fast := startServer(test, &Foo{delay: time.Second}), startServer(test, &Foo{})
+    xc := NewXClient(NewMultiServersDiscovery([]string{slow, fast}), RoundRobinSelect, nil)
+    defer xc.Close()
+    xc.SetCallOption(&CallOption{FailMode: Hedging, HedgeDelay: time.Millisecond * 50})
+
+    for i := 0; i < 2; i++ {
+        var reply int
+        start := time.Now()
+        if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 2}, &reply); err != nil || reply != i + 2 {
+            test.Fatalf("expect %d, got %d, error %v", i + 2, reply, err)
+        }
+        if time.Since(start) > time.Millisecond * 500 {
+            test.Fatal("hedged call should not wait for the slow server, took", time.Since(start))
+        }
+    }
+}
+
+
+func TestCircuitBreaker(test *testing.T) {
+    good, dead := startServer(test, &Foo{}), deadServer(test)
+    xc := NewXClient(NewMultiServersDiscovery([]string{dead, good}), RoundRobinSelect, nil)
+    defer xc.Close()
+    xc.SetBreaker(&BreakerOption{MaxFailures: 2, OpenTimeout: time.Millisecond * 100})
+
+    var reply int
+    failed := 0
+    for i := 0; i < 10; i++ {
+        if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil {
+            failed++
+        }
+    }
+    // 连续失败 2 次后跳过故障实例
+    if failed != 2 {
+        test.Fatal("expect 2 failures before the circuit opens, got", failed)
+    }
+    stats := func(addr string) BackendStats {
+        for _, s := range xc.Stats() {
+            if s.Addr == addr {
+                return s
+            }
+        }
+        return BackendStats{}
+    }
+    if len(xc.Stats()) != 2 || stats(dead).State != CircuitOpen || stats(good).State != CircuitClosed {
+        test.Fatalf("unexpected stats %+v", xc.Stats())
+    }
+
+    // 故障实例恢复后，half-open 的探测请求成功即关闭熔断
+    time.Sleep(time.Millisecond * 120)
+    if stats(dead).State != CircuitHalfOpen {
+        test.Fatal("expect half-open after open timeout")
+    }
+    server := geerpc.NewServer()
+    _ = server.Register(&Foo{})
+    listener, err := net.Listen("tcp", strings.TrimPrefix(dead, "tcp@"))
+    if err != nil {
+        test.Skip("cannot listen on the dead address again:", err)
+    }
+    defer listener.Close()
+    go server.Accept(listener)
+
+    for i := 0; i < 4; i++ {
+        if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil {
+            test.Fatal("call error:", err)
+        }
+    }
+    if s := stats(dead); s.State != CircuitClosed || s.Calls < 4 {
+        test.Fatalf("unexpected stats %+v", s)
+    }
+
+    xc = NewXClient(NewMultiServersDiscovery([]string{deadServer(test)}), RandomSelect, nil)
+    defer xc.Close()
+    xc.SetBreaker(&BreakerOption{MaxFailures: 1, OpenTimeout: time.Minute})
+    _ = xc.Call(context.Background(), "Foo.Sum", &Args{}, &reply)
+    if err := xc.Call(context.Background(), "Foo.Sum", &Args{}, &reply); err != ErrCircuitOpen {
+        test.Fatal("expect ErrCircuitOpen, got", err)
+    }
+}
+
+
+// 被取消的调用不影响熔断状态，只释放 half-open 的探测名额
+func TestBreakerCanceled(test *testing.T) {
+    b := &breakers{opt: &BreakerOption{MaxFailures: 2, OpenTimeout: time.Millisecond * 10}, m: make(map[string]*breaker)}
+    const addr = "tcp@127.0.0.1:1"
+    b.done(addr, 0, callFailed)
+    b.done(addr, 0, callCanceled)
+    if b.m[addr].failures != 1 || b.m[addr].Calls != 1 {
+        test.Fatalf("canceled call should not be recorded: %+v", b.m[addr])
+    }
+    if !b.done(addr, 0, callFailed) {
+        test.Fatal("expect the circuit to open")
+    }
+
+    time.Sleep(time.Millisecond * 20)
+    if !b.acquire(addr) || b.acquire(addr) {
+        test.Fatal("expect exactly one probe in half-open state")
+    }
+    b.done(addr, 0, callCanceled)
+    if b.m[addr].State != CircuitOpen || !b.acquire(addr) {
+        test.Fatal("canceled probe should keep the circuit open and release the probe slot")
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if resultOf(ctx, context.Canceled) != callCanceled || resultOf(context.Background(), errors.New("dial error")) != callFailed {
+        test.Fatal("unexpected call result")
+    }
+}
+
+
+func TestBroadcastAll(test *testing.T) {
+    good1, good2, dead := startServer(test, &Foo{}), startServer(test, &Foo{}), deadServer(test)
+    slow := startServer(test, &Foo{delay: time.Second})
+    xc := NewXClient(NewMultiServersDiscovery([]string{good1, good2, dead}), RandomSelect, nil)
+    defer xc.Close()
+
+    var reply int
+    results, err := xc.BroadcastAll(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+    if err != nil || len(results) != 3 {
+        test.Fatalf("unexpected results %v, error %v", results, err)
+    }
+    for _, addr := range []string{good1, good2} {
+        if results[addr].Err != nil || *results[addr].Reply.(*int) != 3 {
+            test.Fatalf("unexpected result of %s: %+v", addr, results[addr])
+        }
+    }
+    if results[dead].Err == nil || results[dead].Reply != nil {
+        test.Fatalf("dead server should fail: %+v", results[dead])
+    }
+
+    if _, err := xc.Quorum(context.Background(), "Foo.Sum", &Args{Num1: 2, Num2: 2}, &reply, 0); err != nil || reply != 4 {
+        test.Fatalf("expect 4, got %d, error %v", reply, err)
+    }
+    if _, err := xc.Quorum(context.Background(), "Foo.Sum", &Args{}, &reply, 3); err == nil || !strings.Contains(err.Error(), "quorum not reached") {
+        test.Fatal("expect quorum error, got", err)
+    }
+
+    // 达到 quorum 后不等待慢实例
+    _ = xc.d.Update([]string{good1, good2, slow})
+    start := time.Now()
+    results, err = xc.Quorum(context.Background(), "Foo.Sum", &Args{Num1: 3, Num2: 2}, &reply, 2)
+    if err != nil || reply != 5 || len(results) != 2 {
+        test.Fatalf("expect 5 from 2 servers, got %d from %v, error %v", reply, results, err)
+    }
+    if time.Since(start) > time.Millisecond * 500 {
+        test.Fatal("quorum should not wait for the slow server, took", time.Since(start))
+    }
+}
+
+
+func TestPool(test *testing.T) {
+    addr := startServer(test, &Foo{delay: time.Millisecond * 200})
+    xc := NewXClient(NewMultiServersDiscovery([]string{addr}), RandomSelect, nil)
+    defer xc.Close()
+    xc.SetPool(&PoolOption{MaxSize: 2, IdleTimeout: time.Millisecond * 50, CheckInterval: time.Millisecond * 20})
+
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            var reply int
+            if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply); err != nil || reply != i + 1 {
+                test.Errorf("expect %d, got %d, error %v", i + 1, reply, err)
+            }
+        } (i)
+        time.Sleep(time.Millisecond * 10)
+    }
+    wg.Wait()
+    xc.mtx.Lock()
+    p := xc.pools[addr]
+    xc.mtx.Unlock()
+    if p == nil || p.size() != 2 {
+        test.Fatal("expect 2 pooled connections")
+    }
+
+    // 空闲连接被关闭后删除连接池
+    time.Sleep(time.Millisecond * 150)
+    xc.mtx.Lock()
+    n := len(xc.pools)
+    xc.mtx.Unlock()
+    if n != 0 {
+        test.Fatal("idle connections should be evicted")
+    }
+}
+
+
+func TestPoolWait(test *testing.T) {
+    addr := startServer(test, &Foo{})
+    p := newPool(&PoolOption{MaxSize: 1})
+    release := make(chan struct{})
+    result := make(chan error, 1)
+    go func() {
+        _, err := p.get(context.Background(), func() (*geerpc.Client, error) {
+            <-release
+            return geerpc.XDial(addr)
+        })
+        result <- err
+    } ()
+    for p.size() == 0 {
+        time.Sleep(time.Millisecond)
+    }
+
+    // 等待其他连接建立时 ctx 结束
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+    defer cancel()
+    if _, err := p.get(ctx, nil); err != context.DeadlineExceeded {
+        test.Fatal("expect context.DeadlineExceeded, got", err)
+    }
+
+    // 建立连接期间连接池被 checkPools 关闭，调用方应换一个连接池重试
+    p.close()
+    close(release)
+    if err := <-result; err != errPoolClosed {
+        test.Fatal("expect errPoolClosed, got", err)
+    }
+}
+
+
+func TestSlowDial(test *testing.T) {
+    // 接受连接但不响应 CONNECT 的地址，建立连接会一直等到超时
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        test.Fatal("network error:", err)
+    }
+    defer listener.Close()
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+        }
+    } ()
+    slow, good := "http@" + listener.Addr().String(), startServer(test, &Foo{})
+
+    xc := NewXClient(NewMultiServersDiscovery([]string{slow, good}), RoundRobinSelect, &geerpc.Option{ConnectTimeout: time.Second})
+    defer xc.Close()
+    go func() {
+        var reply int
+        _ = xc.call(slow, context.Background(), "Foo.Sum", &Args{}, &reply)
+    } ()
+    time.Sleep(time.Millisecond * 50)
+
+    var reply int
+    start := time.Now()
+    if err := xc.call(good, context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply); err != nil || reply != 3 {
+        test.Fatalf("expect 3, got %d, error %v", reply, err)
+    }
+    if time.Since(start) > time.Millisecond * 500 {
+        test.Fatal("a slow dial should not block other addresses, took", time.Since(start))
+    }
+}
@@ -23,6 +23,8 @@ type Context struct {
     // middleware
     handlers []HandlerFunc
     index int
+    // tracing
+    traceparent string      // Tracing 中间件为当前请求创建的 span
 
     engine *Engine
 }
@@ -0,0 +1,185 @@
+package gee
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+/*
+按 W3C Trace Context 从请求头 traceparent 继续调用链，没有时开始新的调用链。
+处理函数通过 c.Traceparent() 或 TraceparentFromContext(c.Req.Context()) 取得当前 span，
+只拿到 ctx 的下游代码也可以继续调用链，例如 geerpc:
+    ctx := trace.ContextWithTraceparent(ctx, gee.TraceparentFromContext(ctx))
+上游没有采样 (flags 为 00) 的请求不导出 span。
+导出的 span 和 geerpc/trace 的字段相同 (testdata/span.json 和 geerpc/trace 中的样例一致)，写到同一个文件后可以按 TraceID 关联。
+*/
+
+
+const TraceparentHeader = "traceparent"
+
+
+type Span struct {
+    TraceID string
+    SpanID string
+    ParentID string `json:",omitempty"`
+    Name string
+    Kind string
+    Start time.Time
+    End time.Time
+    Attributes map[string]string `json:",omitempty"`
+    Error string `json:",omitempty"`
+}
+
+
+// 接收结束的 span，需要支持并发调用
+type SpanExporter interface {
+    Export(span *Span)
+}
+
+
+// 在内存中保存所有 span，用于测试和调试
+type MemorySpanExporter struct {
+    mtx sync.Mutex
+    spans []*Span
+}
+
+
+func (e *MemorySpanExporter) Export(span *Span) {
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    e.spans = append(e.spans, span)
+}
+
+
+func (e *MemorySpanExporter) Spans() []*Span {
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    return append([]*Span(nil), e.spans...)
+}
+
+
+// 每个 span 作为一行 JSON 写入 w，w 为以 O_APPEND 打开的文件时可以和 geerpc 写同一个文件
+type JSONSpanExporter struct {
+    mtx sync.Mutex
+    w io.Writer
+}
+
+
+func NewJSONSpanExporter(w io.Writer) *JSONSpanExporter {
+    return &JSONSpanExporter{w: w}
+}
+
+
+func (e *JSONSpanExporter) Export(span *Span) {
+    data, err := json.Marshal(span)
+    if err != nil {
+        return
+    }
+    e.mtx.Lock()
+    defer e.mtx.Unlock()
+    _, _ = e.w.Write(append(data, '\n'))
+}
+
+
+func Tracing(exporter SpanExporter) HandlerFunc {
+    return func(c *Context) {
+        span := &Span {
+            Name: c.Method + " " + c.Path,
+            Kind: "server",
+            Start: time.Now(),
+        }
+        traceID, parentID, flags, ok := parseTraceparent(c.Req.Header.Get(TraceparentHeader))
+        if ok {
+            span.ParentID = parentID
+        } else {
+            traceID, flags = randomHex(16), "01"
+        }
+        span.TraceID, span.SpanID = traceID, randomHex(8)
+        c.traceparent = fmt.Sprintf("00-%s-%s-%s", span.TraceID, span.SpanID, flags)
+        c.Req = c.Req.WithContext(context.WithValue(c.Req.Context(), traceparentKey{}, c.traceparent))
+        // flags 已校验为两位十六进制，最低位为采样标记
+        f, _ := strconv.ParseUint(flags, 16, 8)
+        sampled := f & 1 == 1
+
+        completed := false
+        defer func() {
+            status := c.StatusCode
+            if status == 0 {
+                status = 200
+            }
+            if !completed {
+                span.Error, status = "panic", 500      // 由 Recovery 中间件处理
+            } else if status >= 500 {
+                span.Error = "http status " + strconv.Itoa(status)
+            }
+            span.End = time.Now()
+            span.Attributes = map[string]string {
+                "http.method": c.Method,
+                "http.path": c.Path,
+                "http.status": strconv.Itoa(status),
+            }
+            if sampled {
+                exporter.Export(span)
+            }
+        } ()
+
+        c.Next()
+        completed = true
+    }
+}
+
+
+// 当前请求的 traceparent，没有使用 Tracing 中间件时为空
+func (c *Context) Traceparent() string {
+    return c.traceparent
+}
+
+
+type traceparentKey struct{}
+
+
+// Tracing 中间件放入请求 ctx 的 traceparent，没有时为空
+func TraceparentFromContext(ctx context.Context) string {
+    traceparent, _ := ctx.Value(traceparentKey{}).(string)
+    return traceparent
+}
+
+
+// 00-<trace id>-<parent id>-<flags>
+func parseTraceparent(s string) (traceID, parentID, flags string, ok bool) {
+    parts := strings.Split(strings.TrimSpace(s), "-")
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+        return
+    }
+    if !isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) {
+        return
+    }
+    if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+        return
+    }
+    return parts[1], parts[2], parts[3], true
+}
+
+
+func isHex(s string, n int) bool {
+    if len(s) != n || strings.ToLower(s) != s {
+        return false
+    }
+    _, err := hex.DecodeString(s)
+    return err == nil
+}
+
+
+func randomHex(n int) string {
+    b := make([]byte, n)
+    _, _ = rand.Read(b)
+    return hex.EncodeToString(b)
+}
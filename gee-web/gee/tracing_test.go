@@ -0,0 +1,107 @@
+package gee
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+
+func TestTracing(test *testing.T) {
+    exporter := &MemorySpanExporter{}
+    engine := New()
+    engine.Use(Recovery(), Tracing(exporter))
+    var traceparent string
+    engine.GET("/hello", func(c *Context) {
+        traceparent = c.Traceparent()
+        if TraceparentFromContext(c.Req.Context()) != traceparent {
+            test.Error("request context should carry the traceparent")
+        }
+        c.String(http.StatusOK, "hello")
+    })
+    engine.GET("/panic", func(c *Context) {
+        panic("boom")
+    })
+
+    // 继续请求头中的调用链
+    req := httptest.NewRequest("GET", "/hello", nil)
+    req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+    engine.ServeHTTP(httptest.NewRecorder(), req)
+    spans := exporter.Spans()
+    if len(spans) != 1 {
+        test.Fatal("expect 1 span, got", len(spans))
+    }
+    span := spans[0]
+    if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentID != "00f067aa0ba902b7" || span.Attributes["http.status"] != "200" {
+        test.Fatalf("unexpected span %+v", span)
+    }
+    if traceparent != "00-" + span.TraceID + "-" + span.SpanID + "-01" {
+        test.Fatal("unexpected traceparent", traceparent)
+    }
+
+    // 格式错误时开始新的调用链
+    req = httptest.NewRequest("GET", "/panic", nil)
+    req.Header.Set(TraceparentHeader, "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+    engine.ServeHTTP(httptest.NewRecorder(), req)
+    spans = exporter.Spans()
+    if len(spans) != 2 {
+        test.Fatal("expect 2 spans, got", len(spans))
+    }
+    span = spans[1]
+    if span.ParentID != "" || strings.Trim(span.TraceID, "0") == "" || span.Error != "panic" || span.Attributes["http.status"] != "500" {
+        test.Fatalf("unexpected span %+v", span)
+    }
+}
+
+
+func TestTracingUnsampled(test *testing.T) {
+    exporter := &MemorySpanExporter{}
+    engine := New()
+    engine.Use(Tracing(exporter))
+    var traceparent string
+    engine.GET("/hello", func(c *Context) {
+        traceparent = c.Traceparent()
+    })
+
+    // 按十六进制的值取最低位，0a 没有采样，0b 采样
+    for _, c := range []struct {
+        flags string
+        sampled bool
+    }{{"00", false}, {"0a", false}, {"0b", true}, {"01", true}} {
+        req := httptest.NewRequest("GET", "/hello", nil)
+        req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-" + c.flags)
+        engine.ServeHTTP(httptest.NewRecorder(), req)
+        if exported := len(exporter.Spans()) == 1; exported != c.sampled {
+            test.Fatalf("flags %s: expect sampled %v", c.flags, c.sampled)
+        }
+        exporter.mtx.Lock()
+        exporter.spans = nil
+        exporter.mtx.Unlock()
+        if !strings.HasSuffix(traceparent, "-" + c.flags) {
+            test.Fatal("flags should be propagated, got", traceparent)
+        }
+    }
+}
+
+
+// testdata/span.json 和 geerpc/trace/testdata/span.json 相同，保证两边导出的 JSON 字段相同
+func TestSpanSchema(test *testing.T) {
+    fixture, err := os.ReadFile(filepath.Join("testdata", "span.json"))
+    if err != nil {
+        test.Fatal("read fixture error:", err)
+    }
+    fixture = bytes.TrimSpace(fixture)
+    span := &Span{}
+    if err := json.Unmarshal(fixture, span); err != nil {
+        test.Fatal("decode span error:", err)
+    }
+    data, _ := json.Marshal(span)
+    if !bytes.Equal(data, fixture) {
+        test.Fatalf("span schema differs from geerpc:\n%s\n%s", data, fixture)
+    }
+}